@@ -1,5 +1,7 @@
 package hkontroller
 
+import "sort"
+
 type Accessory struct {
 	Id uint64                `json:"aid"`
 	Ss []*ServiceDescription `json:"services"`
@@ -9,6 +11,29 @@ type Accessories struct {
 	Accs []*Accessory `json:"accessories,omitempty"`
 }
 
+// copyAccessories returns copy of accessories, their services and characteristics.
+func copyAccessories(accs []*Accessory) []*Accessory {
+	if accs == nil {
+		return nil
+	}
+	result := make([]*Accessory, len(accs))
+	for i, a := range accs {
+		ac := *a
+		ac.Ss = make([]*ServiceDescription, len(a.Ss))
+		for j, s := range a.Ss {
+			sc := *s
+			sc.Cs = make([]*CharacteristicDescription, len(s.Cs))
+			for k, c := range s.Cs {
+				cc := *c
+				sc.Cs[k] = &cc
+			}
+			ac.Ss[j] = &sc
+		}
+		result[i] = &ac
+	}
+	return result
+}
+
 func (a *Accessory) GetService(serviceType HapServiceType) *ServiceDescription {
 
 	for _, s := range a.Ss {
@@ -19,3 +44,115 @@ func (a *Accessory) GetService(serviceType HapServiceType) *ServiceDescription {
 
 	return nil
 }
+
+// ServiceID identifies service by accessory and instance ids.
+type ServiceID struct {
+	Aid uint64
+	Iid uint64
+}
+
+// AccessoriesDiff describes changes of accessory database.
+// Service or characteristic with changed type is reported as removed and added.
+type AccessoriesDiff struct {
+	AddedAccessories       []uint64
+	RemovedAccessories     []uint64
+	AddedServices          []ServiceID
+	RemovedServices        []ServiceID
+	AddedCharacteristics   []CharacteristicID
+	RemovedCharacteristics []CharacteristicID
+}
+
+// IsEmpty returns true if there are no changes.
+func (d AccessoriesDiff) IsEmpty() bool {
+	return len(d.AddedAccessories) == 0 && len(d.RemovedAccessories) == 0 &&
+		len(d.AddedServices) == 0 && len(d.RemovedServices) == 0 &&
+		len(d.AddedCharacteristics) == 0 && len(d.RemovedCharacteristics) == 0
+}
+
+// DiffAccessories compares two accessory lists.
+func DiffAccessories(old []*Accessory, new []*Accessory) AccessoriesDiff {
+	type index struct {
+		accs  map[uint64]bool
+		servs map[ServiceID]HapServiceType
+		chars map[CharacteristicID]HapCharacteristicType
+	}
+	build := func(accs []*Accessory) index {
+		idx := index{
+			accs:  make(map[uint64]bool),
+			servs: make(map[ServiceID]HapServiceType),
+			chars: make(map[CharacteristicID]HapCharacteristicType),
+		}
+		for _, a := range accs {
+			idx.accs[a.Id] = true
+			for _, s := range a.Ss {
+				idx.servs[ServiceID{a.Id, s.Id}] = s.Type.ToShort()
+				for _, c := range s.Cs {
+					idx.chars[CharacteristicID{a.Id, c.Iid}] = c.Type.ToShort()
+				}
+			}
+		}
+		return idx
+	}
+	o := build(old)
+	n := build(new)
+
+	var diff AccessoriesDiff
+	for aid := range n.accs {
+		if !o.accs[aid] {
+			diff.AddedAccessories = append(diff.AddedAccessories, aid)
+		}
+	}
+	for aid := range o.accs {
+		if !n.accs[aid] {
+			diff.RemovedAccessories = append(diff.RemovedAccessories, aid)
+		}
+	}
+	for id, t := range n.servs {
+		if ot, ok := o.servs[id]; !ok || ot != t {
+			diff.AddedServices = append(diff.AddedServices, id)
+		}
+	}
+	for id, t := range o.servs {
+		if nt, ok := n.servs[id]; !ok || nt != t {
+			diff.RemovedServices = append(diff.RemovedServices, id)
+		}
+	}
+	for id, t := range n.chars {
+		if ot, ok := o.chars[id]; !ok || ot != t {
+			diff.AddedCharacteristics = append(diff.AddedCharacteristics, id)
+		}
+	}
+	for id, t := range o.chars {
+		if nt, ok := n.chars[id]; !ok || nt != t {
+			diff.RemovedCharacteristics = append(diff.RemovedCharacteristics, id)
+		}
+	}
+
+	sort.Slice(diff.AddedAccessories, func(i, j int) bool {
+		return diff.AddedAccessories[i] < diff.AddedAccessories[j]
+	})
+	sort.Slice(diff.RemovedAccessories, func(i, j int) bool {
+		return diff.RemovedAccessories[i] < diff.RemovedAccessories[j]
+	})
+	sort.Slice(diff.AddedServices, func(i, j int) bool {
+		return lessId(diff.AddedServices[i], diff.AddedServices[j])
+	})
+	sort.Slice(diff.RemovedServices, func(i, j int) bool {
+		return lessId(diff.RemovedServices[i], diff.RemovedServices[j])
+	})
+	sort.Slice(diff.AddedCharacteristics, func(i, j int) bool {
+		return lessId(ServiceID(diff.AddedCharacteristics[i]), ServiceID(diff.AddedCharacteristics[j]))
+	})
+	sort.Slice(diff.RemovedCharacteristics, func(i, j int) bool {
+		return lessId(ServiceID(diff.RemovedCharacteristics[i]), ServiceID(diff.RemovedCharacteristics[j]))
+	})
+
+	return diff
+}
+
+func lessId(a ServiceID, b ServiceID) bool {
+	if a.Aid != b.Aid {
+		return a.Aid < b.Aid
+	}
+	return a.Iid < b.Iid
+}
@@ -0,0 +1,451 @@
+package hkontroller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Formats of characteristic value.
+const (
+	FormatBool   = "bool"
+	FormatUInt8  = "uint8"
+	FormatUInt16 = "uint16"
+	FormatUInt32 = "uint32"
+	FormatUInt64 = "uint64"
+	FormatInt    = "int"
+	FormatFloat  = "float"
+	FormatString = "string"
+	FormatTLV8   = "tlv8"
+	FormatData   = "data"
+)
+
+// defaultMaxLen is max length of string value if maxLen is not specified.
+const defaultMaxLen = 64
+
+// stepTolerance is allowed deviation of value from multiple of minStep.
+const stepTolerance = 1e-6
+
+// integerRanges are limits of integer formats.
+var integerRanges = map[string][2]*big.Int{
+	FormatUInt8:  {big.NewInt(0), big.NewInt(math.MaxUint8)},
+	FormatUInt16: {big.NewInt(0), big.NewInt(math.MaxUint16)},
+	FormatUInt32: {big.NewInt(0), big.NewInt(math.MaxUint32)},
+	FormatUInt64: {big.NewInt(0), new(big.Int).SetUint64(math.MaxUint64)},
+	FormatInt:    {big.NewInt(math.MinInt32), big.NewInt(math.MaxInt32)},
+}
+
+// ValueError is returned when value does not match
+// format or constraints of characteristic.
+type ValueError struct {
+	Aid    uint64
+	Iid    uint64
+	Format string
+	Value  interface{}
+	Reason string
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("invalid value %v of characteristic %d.%d with format %s: %s",
+		e.Value, e.Aid, e.Iid, e.Format, e.Reason)
+}
+
+func (c *CharacteristicDescription) format() string {
+	if c.Format == nil {
+		return ""
+	}
+	return *c.Format
+}
+
+func (c *CharacteristicDescription) valueError(aid uint64, v interface{}, reason string, args ...interface{}) error {
+	return &ValueError{
+		Aid:    aid,
+		Iid:    c.Iid,
+		Format: c.format(),
+		Value:  v,
+		Reason: fmt.Sprintf(reason, args...),
+	}
+}
+
+// toFloat converts numeric value, e.g. float64 decoded from json.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toBigFloat converts numeric value without loss of precision,
+// so integers above 2^53 are compared exactly.
+func toBigFloat(v interface{}) (*big.Float, bool) {
+	switch n := v.(type) {
+	case float64:
+		if math.IsNaN(n) {
+			return nil, false
+		}
+		return new(big.Float).SetFloat64(n), true
+	case float32:
+		return toBigFloat(float64(n))
+	case int:
+		return new(big.Float).SetInt64(int64(n)), true
+	case int8:
+		return new(big.Float).SetInt64(int64(n)), true
+	case int16:
+		return new(big.Float).SetInt64(int64(n)), true
+	case int32:
+		return new(big.Float).SetInt64(int64(n)), true
+	case int64:
+		return new(big.Float).SetInt64(n), true
+	case uint:
+		return new(big.Float).SetUint64(uint64(n)), true
+	case uint8:
+		return new(big.Float).SetUint64(uint64(n)), true
+	case uint16:
+		return new(big.Float).SetUint64(uint64(n)), true
+	case uint32:
+		return new(big.Float).SetUint64(uint64(n)), true
+	case uint64:
+		return new(big.Float).SetUint64(n), true
+	case json.Number:
+		f, _, err := big.ParseFloat(n.String(), 10, 256, big.ToNearestEven)
+		return f, err == nil
+	}
+	return nil, false
+}
+
+// toBigInt converts numeric value with no fractional part.
+func toBigInt(v interface{}) (*big.Int, bool) {
+	f, ok := toBigFloat(v)
+	if !ok || !f.IsInt() {
+		return nil, false
+	}
+	n, _ := f.Int(nil)
+	return n, true
+}
+
+func isIntegerFormat(format string) bool {
+	_, ok := integerRanges[format]
+	return ok
+}
+
+// Bool returns value of characteristic with bool format.
+// Numeric 0 and 1 are accepted as well, some accessories report them.
+func (c *CharacteristicDescription) Bool() (bool, error) {
+	if f := c.format(); f != "" && f != FormatBool {
+		return false, c.valueError(c.Aid, c.Value, "not a bool characteristic")
+	}
+	switch v := c.Value.(type) {
+	case bool:
+		return v, nil
+	}
+	if n, ok := toFloat(c.Value); ok && (n == 0 || n == 1) {
+		return n == 1, nil
+	}
+	return false, c.valueError(c.Aid, c.Value, "value is not bool")
+}
+
+// Int returns value of characteristic with integer format.
+func (c *CharacteristicDescription) Int() (int64, error) {
+	if f := c.format(); f != "" && !isIntegerFormat(f) {
+		return 0, c.valueError(c.Aid, c.Value, "not an integer characteristic")
+	}
+	n, ok := toBigInt(c.Value)
+	if !ok || !n.IsInt64() {
+		return 0, c.valueError(c.Aid, c.Value, "value is not integer")
+	}
+	return n.Int64(), nil
+}
+
+// Float returns value of characteristic with float or integer format.
+func (c *CharacteristicDescription) Float() (float64, error) {
+	if f := c.format(); f != "" && f != FormatFloat && !isIntegerFormat(f) {
+		return 0, c.valueError(c.Aid, c.Value, "not a numeric characteristic")
+	}
+	n, ok := toFloat(c.Value)
+	if !ok {
+		return 0, c.valueError(c.Aid, c.Value, "value is not numeric")
+	}
+	return n, nil
+}
+
+// StringValue returns value of characteristic with string format.
+// It is not named String, so CharacteristicDescription is not mistaken for fmt.Stringer.
+func (c *CharacteristicDescription) StringValue() (string, error) {
+	if f := c.format(); f != "" && f != FormatString {
+		return "", c.valueError(c.Aid, c.Value, "not a string characteristic")
+	}
+	s, ok := c.Value.(string)
+	if !ok {
+		return "", c.valueError(c.Aid, c.Value, "value is not string")
+	}
+	return s, nil
+}
+
+// TLV8 returns decoded value of characteristic with tlv8 format.
+// Result may be parsed with tlv8.Unmarshal.
+func (c *CharacteristicDescription) TLV8() ([]byte, error) {
+	return c.base64Value(FormatTLV8)
+}
+
+// Data returns decoded value of characteristic with data format.
+func (c *CharacteristicDescription) Data() ([]byte, error) {
+	return c.base64Value(FormatData)
+}
+
+func (c *CharacteristicDescription) base64Value(format string) ([]byte, error) {
+	if f := c.format(); f != "" && f != format {
+		return nil, c.valueError(c.Aid, c.Value, "not a %s characteristic", format)
+	}
+	s, ok := c.Value.(string)
+	if !ok {
+		return nil, c.valueError(c.Aid, c.Value, "value is not base64 string")
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, c.valueError(c.Aid, c.Value, "%v", err)
+	}
+	return b, nil
+}
+
+// SetBool validates and sets value of characteristic with bool format.
+func (c *CharacteristicDescription) SetBool(v bool) error {
+	return c.setValue(v)
+}
+
+// SetInt validates and sets value of characteristic with integer format.
+func (c *CharacteristicDescription) SetInt(v int64) error {
+	return c.setValue(v)
+}
+
+// SetFloat validates and sets value of characteristic with float format.
+func (c *CharacteristicDescription) SetFloat(v float64) error {
+	return c.setValue(v)
+}
+
+// SetString validates and sets value of characteristic with string format.
+func (c *CharacteristicDescription) SetString(v string) error {
+	return c.setValue(v)
+}
+
+// SetTLV8 validates and sets value of characteristic with tlv8 format.
+// Value is encoded as base64 string.
+func (c *CharacteristicDescription) SetTLV8(v []byte) error {
+	if f := c.format(); f != "" && f != FormatTLV8 {
+		return c.valueError(c.Aid, v, "not a tlv8 characteristic")
+	}
+	return c.setValue(v)
+}
+
+// SetData validates and sets value of characteristic with data format.
+// Value is encoded as base64 string.
+func (c *CharacteristicDescription) SetData(v []byte) error {
+	if f := c.format(); f != "" && f != FormatData {
+		return c.valueError(c.Aid, v, "not a data characteristic")
+	}
+	return c.setValue(v)
+}
+
+func (c *CharacteristicDescription) setValue(v interface{}) error {
+	value, err := c.ValidateValue(v)
+	if err != nil {
+		return err
+	}
+	c.Value = value
+	return nil
+}
+
+// ValidateValue checks value against format, minValue, maxValue, minStep,
+// maxLen, valid-values and valid-values-range of characteristic.
+// It returns value converted to representation expected by accessory,
+// e.g. []byte is encoded as base64 string for tlv8 and data formats.
+// Value is not checked if characteristic has no format,
+// that is the case for characteristics read without meta.
+func (c *CharacteristicDescription) ValidateValue(v interface{}) (interface{}, error) {
+	return c.validate(c.Aid, v)
+}
+
+func (c *CharacteristicDescription) validate(aid uint64, v interface{}) (interface{}, error) {
+	format := c.format()
+	switch {
+	case format == "":
+		if b, ok := v.([]byte); ok {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return v, nil
+	case format == FormatBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		if n, ok := toFloat(v); ok && (n == 0 || n == 1) {
+			return n == 1, nil
+		}
+		return nil, c.valueError(aid, v, "expected bool")
+	case format == FormatFloat:
+		n, ok := toFloat(v)
+		if !ok {
+			return nil, c.valueError(aid, v, "expected number")
+		}
+		if err := c.validateNumber(aid, v, n); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case isIntegerFormat(format):
+		f, ok := toBigFloat(v)
+		if !ok {
+			return nil, c.valueError(aid, v, "expected integer")
+		}
+		if !f.IsInt() {
+			return nil, c.valueError(aid, v, "expected integer, got fraction")
+		}
+		n, _ := f.Int(nil)
+		limits := integerRanges[format]
+		if n.Cmp(limits[0]) < 0 || n.Cmp(limits[1]) > 0 {
+			return nil, c.valueError(aid, v, "out of %s range", format)
+		}
+		if err := c.validateInteger(aid, v, n); err != nil {
+			return nil, err
+		}
+		if format == FormatUInt64 {
+			return n.Uint64(), nil
+		}
+		return n.Int64(), nil
+	case format == FormatString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, c.valueError(aid, v, "expected string")
+		}
+		maxLen := defaultMaxLen
+		if c.MaxLen != nil {
+			maxLen = *c.MaxLen
+		}
+		if len(s) > maxLen {
+			return nil, c.valueError(aid, v, "length %d exceeds maxLen %d", len(s), maxLen)
+		}
+		return s, nil
+	case format == FormatTLV8, format == FormatData:
+		switch b := v.(type) {
+		case []byte:
+			return base64.StdEncoding.EncodeToString(b), nil
+		case string:
+			if _, err := base64.StdEncoding.DecodeString(b); err != nil {
+				return nil, c.valueError(aid, v, "expected base64 string: %v", err)
+			}
+			return b, nil
+		}
+		return nil, c.valueError(aid, v, "expected bytes or base64 string")
+	}
+	return nil, c.valueError(aid, v, "unknown format")
+}
+
+// validateNumber checks value of float format against constraints of characteristic.
+func (c *CharacteristicDescription) validateNumber(aid uint64, v interface{}, n float64) error {
+	minValue, hasMin := toFloat(c.MinValue)
+	maxValue, hasMax := toFloat(c.MaxValue)
+	if hasMin && n < minValue {
+		return c.valueError(aid, v, "less than minValue %v", minValue)
+	}
+	if hasMax && n > maxValue {
+		return c.valueError(aid, v, "greater than maxValue %v", maxValue)
+	}
+	if step, ok := toFloat(c.MinStep); ok && step > 0 {
+		// steps are counted from minValue
+		k := (n - minValue) / step
+		if math.Abs(k-math.Round(k)) > stepTolerance {
+			return c.valueError(aid, v, "not a multiple of minStep %v", step)
+		}
+	}
+	if len(c.ValidValues) > 0 {
+		valid := false
+		for _, vv := range c.ValidValues {
+			if float64(vv) == n {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return c.valueError(aid, v, "not one of valid-values %v", c.ValidValues)
+		}
+	}
+	if len(c.ValidRange) == 2 {
+		if n < float64(c.ValidRange[0]) || n > float64(c.ValidRange[1]) {
+			return c.valueError(aid, v, "out of valid-values-range %v", c.ValidRange)
+		}
+	}
+	return nil
+}
+
+// validateInteger checks value of integer format against constraints of characteristic.
+// Values are compared exactly, float64 can't represent every uint64.
+func (c *CharacteristicDescription) validateInteger(aid uint64, v interface{}, n *big.Int) error {
+	f := new(big.Float).SetInt(n)
+	if minValue, ok := toBigFloat(c.MinValue); ok && f.Cmp(minValue) < 0 {
+		return c.valueError(aid, v, "less than minValue %v", c.MinValue)
+	}
+	if maxValue, ok := toBigFloat(c.MaxValue); ok && f.Cmp(maxValue) > 0 {
+		return c.valueError(aid, v, "greater than maxValue %v", c.MaxValue)
+	}
+	if step, ok := toBigInt(c.MinStep); ok && step.Sign() > 0 {
+		// steps are counted from minValue
+		minValue, ok := toBigInt(c.MinValue)
+		if !ok {
+			minValue = new(big.Int)
+		}
+		if new(big.Int).Mod(new(big.Int).Sub(n, minValue), step).Sign() != 0 {
+			return c.valueError(aid, v, "not a multiple of minStep %v", c.MinStep)
+		}
+	} else if step, ok := toFloat(c.MinStep); ok && step > 0 {
+		// fractional step, precision of float64 is enough
+		minValue, _ := toFloat(c.MinValue)
+		x, _ := f.Float64()
+		k := (x - minValue) / step
+		if math.Abs(k-math.Round(k)) > stepTolerance {
+			return c.valueError(aid, v, "not a multiple of minStep %v", step)
+		}
+	}
+	if len(c.ValidValues) > 0 {
+		valid := false
+		for _, vv := range c.ValidValues {
+			if n.Cmp(big.NewInt(int64(vv))) == 0 {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return c.valueError(aid, v, "not one of valid-values %v", c.ValidValues)
+		}
+	}
+	if len(c.ValidRange) == 2 {
+		if n.Cmp(big.NewInt(int64(c.ValidRange[0]))) < 0 || n.Cmp(big.NewInt(int64(c.ValidRange[1]))) > 0 {
+			return c.valueError(aid, v, "out of valid-values-range %v", c.ValidRange)
+		}
+	}
+	return nil
+}
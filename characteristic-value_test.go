@@ -0,0 +1,136 @@
+package hkontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestCharacteristicGetters(t *testing.T) {
+	c := CharacteristicDescription{Format: stringPtr(FormatUInt8), Value: float64(42)}
+	i, err := c.Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := i, int64(42); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if _, err := c.Bool(); err == nil {
+		t.Fatal("uint8 is read as bool")
+	}
+
+	c = CharacteristicDescription{Format: stringPtr(FormatBool), Value: float64(1)}
+	b, err := c.Bool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := b, true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	c = CharacteristicDescription{Format: stringPtr(FormatTLV8), Value: "AQEA"}
+	data, err := c.TLV8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := string(data), "\x01\x01\x00"; is != want {
+		t.Fatalf("is=%q want=%q", is, want)
+	}
+	if _, err := c.Data(); err == nil {
+		t.Fatal("tlv8 is read as data")
+	}
+
+	// no format without meta
+	c = CharacteristicDescription{Value: "Lamp"}
+	s, err := c.StringValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := s, "Lamp"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestCharacteristicValidateValue(t *testing.T) {
+	maxLen := 4
+	tests := []struct {
+		c     CharacteristicDescription
+		value interface{}
+		want  interface{}
+	}{
+		{CharacteristicDescription{Format: stringPtr(FormatBool)}, true, true},
+		{CharacteristicDescription{Format: stringPtr(FormatBool)}, 0, false},
+		{CharacteristicDescription{Format: stringPtr(FormatBool)}, 2, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8)}, 255, int64(255)},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8)}, 256, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8)}, 1.5, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatInt), MinValue: float64(0), MaxValue: float64(100)}, 100, int64(100)},
+		{CharacteristicDescription{Format: stringPtr(FormatInt), MinValue: float64(0), MaxValue: float64(100)}, -1, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatFloat), MinValue: 10, MinStep: 0.1}, 21.3, 21.3},
+		{CharacteristicDescription{Format: stringPtr(FormatFloat), MinValue: 10, MinStep: 0.5}, 21.3, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8), ValidValues: []int{0, 2}}, 2, int64(2)},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8), ValidValues: []int{0, 2}}, 1, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt8), ValidRange: []int{1, 3}}, 4, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64)}, uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64)}, json.Number("18446744073709551616"), nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64), MaxValue: uint64(1 << 60)}, uint64(1<<60 + 1), nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64), ValidRange: []int{0, 1 << 60}}, uint64(math.MaxUint64), nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64), ValidValues: []int{1 << 60}}, uint64(1<<60 + 1), nil},
+		{CharacteristicDescription{Format: stringPtr(FormatUInt64), MinStep: 2}, uint64(1<<60 + 1), nil},
+		{CharacteristicDescription{Format: stringPtr(FormatString), MaxLen: &maxLen}, "Lamp", "Lamp"},
+		{CharacteristicDescription{Format: stringPtr(FormatString), MaxLen: &maxLen}, "Lamps", nil},
+		{CharacteristicDescription{Format: stringPtr(FormatString)}, 1, nil},
+		{CharacteristicDescription{Format: stringPtr(FormatData)}, []byte{1, 1, 0}, "AQEA"},
+		{CharacteristicDescription{Format: stringPtr(FormatData)}, "not base64!", nil},
+		{CharacteristicDescription{}, "anything", "anything"},
+	}
+
+	for i, test := range tests {
+		v, err := test.c.ValidateValue(test.value)
+		if test.want == nil {
+			var valueErr *ValueError
+			if !errors.As(err, &valueErr) {
+				t.Fatalf("%d: unexpected error %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if is, want := v, test.want; is != want {
+			t.Fatalf("%d: is=%v want=%v", i, is, want)
+		}
+	}
+}
+
+func TestCharacteristicSetters(t *testing.T) {
+	c := CharacteristicDescription{
+		Aid:      1,
+		Iid:      11,
+		Format:   stringPtr(FormatInt),
+		Value:    float64(100),
+		MinValue: float64(0),
+		MaxValue: float64(100),
+		MinStep:  float64(1),
+	}
+	if err := c.SetInt(50); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := c.Value, int64(50); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := c.SetInt(150); err == nil {
+		t.Fatal("value greater than maxValue is set")
+	}
+	if is, want := c.Value, int64(50); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := c.SetTLV8([]byte{1}); err == nil {
+		t.Fatal("tlv8 is set to int characteristic")
+	}
+}
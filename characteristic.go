@@ -64,3 +64,26 @@ type CharacteristicPut struct {
 type CharacteristicEvent struct {
 	Characteristics []CharacteristicDescription `json:"characteristics"`
 }
+
+// CharacteristicID identifies characteristic by accessory and instance ids.
+type CharacteristicID struct {
+	Aid uint64
+	Iid uint64
+}
+
+// ReadOptions are query flags of GET /characteristics request.
+type ReadOptions struct {
+	Meta   bool // include format, unit, min/max values, etc
+	Perms  bool // include permissions
+	Type   bool // include characteristic type
+	Events bool // include event notification state
+}
+
+// CharacteristicResult is the outcome of writing single characteristic.
+type CharacteristicResult struct {
+	Aid    uint64
+	Iid    uint64
+	Status int         // HAP status code, JsonStatusSuccess on success
+	Err    error       // *JsonStatusError if Status is not JsonStatusSuccess
+	Value  interface{} // value returned by accessory if write-response was requested
+}
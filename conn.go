@@ -7,17 +7,18 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hkontrol/dnssd"
-	"github.com/hkontrol/hkontroller/log"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // dialServiceInstance lookup dnssd service and make tcp connection
-func dialServiceInstance(ctx context.Context, e *dnssd.BrowseEntry, dialTimeout time.Duration) (net.Conn, error) {
+func dialServiceInstance(ctx context.Context, e *dnssd.BrowseEntry, dialTimeout time.Duration, logger *slog.Logger) (net.Conn, error) {
 
 	IPs := e.IPs
 	sort.Slice(IPs, func(i, j int) bool {
@@ -43,7 +44,7 @@ func dialServiceInstance(ctx context.Context, e *dnssd.BrowseEntry, dialTimeout
 			tcpAddr = fmt.Sprintf("%s:%d", ip.String(), e.Port)
 		}
 
-		log.Debug.Println("dialing: ", tcpAddr)
+		logger.Debug("dialing", "addr", tcpAddr)
 
 		wg.Add(1)
 		go func(tcpAddr string) {
@@ -52,10 +53,10 @@ func dialServiceInstance(ctx context.Context, e *dnssd.BrowseEntry, dialTimeout
 			d := net.Dialer{Timeout: dialTimeout}
 			tcpConn, err := d.DialContext(cc, "tcp", tcpAddr)
 			if err != nil {
-				log.Debug.Println("dial err: ", err)
+				logger.Debug("dial failed", "addr", tcpAddr, "err", err)
 				return
 			}
-			log.Debug.Println("dial good")
+			logger.Debug("dial succeeded", "addr", tcpAddr)
 			mu.Lock()
 			defer mu.Unlock()
 			if firstEstablishedConn == nil {
@@ -126,10 +127,15 @@ func (t *eventTransformer) Read(p []byte) (n int, err error) {
 	return t.readIndex + nn, err
 }
 
+// conn is connection to accessory.
+// Requests are written by round tripper one at a time. Until inBackground is set,
+// responses are read by round tripper as well, afterwards loop reads
+// responses and events and hands responses over to waiting request.
 type conn struct {
 	net.Conn
 
-	closed bool
+	closed atomic.Bool
+	logger *slog.Logger
 
 	// s and ss are used to encrypt data. s is used to temporarily store the session.
 	// After the next read, ss becomes s and the session is encrypted from then on.
@@ -143,34 +149,96 @@ type conn struct {
 	readBuf   io.Reader
 	bufReader *bufio.Reader
 
-	inBackground   bool
-	backgroundStop chan interface{}
+	inBackground   atomic.Bool
+	backgroundStop chan interface{} // closed when loop exits
 
 	onEvent func(*http.Response) // EVENT callback, when characteristic value updated
 
-	// indicates if response channel is open. it may be closed if request context was done
-	wantResponse bool
-	response     chan *http.Response // assume that one request wants one response
-	resError     chan error
+	// waiter receives response read by loop, nil if no request is waiting.
+	// discard is number of responses to requests given up on,
+	// which are still to be read and must not reach next waiter.
+	rmu     sync.Mutex
+	waiter  chan responseResult
+	discard int
 }
 
-func newConn(c net.Conn) *conn {
+type responseResult struct {
+	res *http.Response
+	err error
+}
+
+func newConn(c net.Conn, logger *slog.Logger) *conn {
 	cc := &conn{
-		Conn:     c,
-		smu:      sync.Mutex{},
-		response: make(chan *http.Response),
-		resError: make(chan error),
-		closed:   false,
+		Conn:           c,
+		logger:         logger,
+		smu:            sync.Mutex{},
+		backgroundStop: make(chan interface{}),
 	}
 
 	return cc
 }
 
 func (c *conn) close() {
-	c.closed = true
+	c.closed.Store(true)
 	c.Conn.Close()
 }
 
+func (c *conn) isClosed() bool {
+	return c.closed.Load()
+}
+
+func (c *conn) session() *session {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.ss
+}
+
+// expectResponse registers request waiting for response read by loop.
+func (c *conn) expectResponse() <-chan responseResult {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.waiter = make(chan responseResult, 1)
+	return c.waiter
+}
+
+// cancelResponse forgets waiting request, e.g. if its context is done.
+func (c *conn) cancelResponse() {
+	c.rmu.Lock()
+	c.waiter = nil
+	c.rmu.Unlock()
+}
+
+// discardResponse forgets waiting request which was already written,
+// so its response is dropped once read instead of being passed to next request.
+func (c *conn) discardResponse() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.waiter != nil {
+		c.waiter = nil
+		c.discard++
+	}
+}
+
+// deliverResponse passes response to waiting request.
+// Response nobody waits for is dropped.
+func (c *conn) deliverResponse(res *http.Response, err error) {
+	c.rmu.Lock()
+	if c.discard > 0 {
+		// responses come in order of requests,
+		// so this one belongs to request given up on
+		c.discard--
+		c.rmu.Unlock()
+		c.logger.Debug("dropping response of canceled request")
+		return
+	}
+	w := c.waiter
+	c.waiter = nil
+	c.rmu.Unlock()
+	if w != nil {
+		w <- responseResult{res, err}
+	}
+}
+
 func (c *conn) SetEventCallback(cb func(*http.Response)) {
 	c.onEvent = cb
 }
@@ -184,7 +252,8 @@ func (c *conn) UpgradeEnc(s *session) {
 // Write writes bytes to the connection.
 // The written bytes are encrypted when possible.
 func (c *conn) Write(b []byte) (int, error) {
-	if c.ss == nil {
+	ss := c.session()
+	if ss == nil {
 		n, err := c.Conn.Write(b)
 		if err != nil {
 			c.close()
@@ -195,7 +264,7 @@ func (c *conn) Write(b []byte) (int, error) {
 
 	var buf bytes.Buffer
 	buf.Write(b)
-	enc, err := c.ss.Encrypt(&buf)
+	enc, err := ss.Encrypt(&buf)
 
 	if err != nil {
 		c.close()
@@ -215,7 +284,8 @@ const (
 // Read reads bytes from the connection.
 // The read bytes are decrypted when possible.
 func (c *conn) Read(b []byte) (int, error) {
-	if c.ss == nil {
+	ss := c.session()
+	if ss == nil {
 		n, err := c.Conn.Read(b)
 		if err != nil {
 			c.close()
@@ -227,7 +297,7 @@ func (c *conn) Read(b []byte) (int, error) {
 		c.bufReader = bufio.NewReader(c.Conn)
 	}
 	if c.readBuf == nil {
-		buf, err := c.ss.Decrypt(c.bufReader)
+		buf, err := ss.Decrypt(c.bufReader)
 		if err != nil {
 			c.close()
 			return 0, err
@@ -245,20 +315,19 @@ func (c *conn) Read(b []byte) (int, error) {
 	return n, err
 }
 
+// loop reads responses and events until connection is closed.
+// inBackground should be set before loop is started,
+// so requests don't read from connection concurrently with it.
+// inBackground stays set after loop exits, requests fail with backgroundStop.
 func (c *conn) loop() {
-	c.backgroundStop = make(chan interface{})
 	defer func() {
 		close(c.backgroundStop)
 	}()
-	c.inBackground = true
-	defer func() {
-		c.inBackground = false
-	}()
 	rd := bufio.NewReader(c)
-	for !c.closed {
+	for !c.isClosed() {
 		b, err := rd.Peek(len(eventHeader)) // len of EVENT string
 		if err != nil {
-			log.Debug.Println("error reading from connection: ", err)
+			c.logger.Debug("reading from connection failed", "err", err)
 			return
 		}
 		//fmt.Println("---")
@@ -289,10 +358,8 @@ func (c *conn) loop() {
 		} else {
 			res, err := http.ReadResponse(rd, nil)
 			if err != nil {
-				log.Debug.Println("response error: ", err)
-				if c.wantResponse {
-					c.resError <- err
-				}
+				c.logger.Debug("reading response failed", "err", err)
+				c.deliverResponse(nil, err)
 				continue
 			}
 			//dump, err := httputil.DumpResponse(res, false)
@@ -305,19 +372,38 @@ func (c *conn) loop() {
 			//fmt.Println("reading HTTP response body done. err: ", err)
 			res.Body.Close()
 			if err != nil {
-				log.Debug.Println("response body read error: ", err)
-				if c.wantResponse {
-					c.resError <- err
-				}
+				c.logger.Debug("reading response body failed", "err", err)
+				c.deliverResponse(nil, err)
 				continue
 			}
 
 			// then assign new res.Body
 			res.Body = io.NopCloser(bytes.NewReader(all))
 
-			if c.wantResponse {
-				c.response <- res
-			}
+			c.deliverResponse(res, nil)
 		}
 	}
 }
+
+// watchContext sets connection deadline from ctx and interrupts
+// blocking i/o when ctx is cancelled. Returned func resets deadline.
+func (c *conn) watchContext(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.Conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.Conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		c.Conn.SetDeadline(time.Time{})
+	}
+}
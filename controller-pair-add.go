@@ -2,11 +2,10 @@ package hkontroller
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 
 	"github.com/hkontrol/hkontroller/tlv8"
 )
@@ -26,20 +25,27 @@ type pairAddResPayload struct {
 
 // PairAdd serves to pair another controller.
 func (d *Device) PairAdd(p Pairing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.PairAddContext(ctx, p)
+}
+
+// PairAddContext is like PairAdd but uses ctx for the request.
+func (d *Device) PairAddContext(ctx context.Context, p Pairing) error {
 
 	pl := pairAddReqPayload{
 		State:       M1,
 		Method:      MethodAddPairing,
 		Identifier:  p.Id,
 		PublicKey:   p.PublicKey,
-		Permissions: p.Permission,
+		Permissions: byte(p.Permission),
 	}
 	b, err := tlv8.Marshal(pl)
 	if err != nil {
 		return err
 	}
 
-	resp, err := d.doPost("/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -54,14 +60,12 @@ func (d *Device) PairAdd(p Pairing) error {
 	}
 	m2 := pairAddResPayload{}
 	err = tlv8.Unmarshal(all, &m2)
-
-	if m2.Error != 0x00 {
-		return errors.New("res.err = " + strconv.FormatInt(int64(m2.Error), 10))
-	}
-
 	if err != nil {
 		return err
 	}
+	if m2.Error != 0x00 {
+		return TlvErrorFromCode(m2.Error)
+	}
 
 	return nil
 }
@@ -2,8 +2,7 @@ package hkontroller
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -20,9 +19,21 @@ type pairingPayload struct {
 	PublicKey  []byte `tlv8:"3"`
 	Permission byte   `tlv8:"11"`
 }
+type pairListResPayload struct {
+	State    byte             `tlv8:"6"`
+	Error    byte             `tlv8:"7"`
+	Pairings []pairingPayload `tlv8:"-"` // separated by 0xff
+}
 
 // ListPairings should list all controllers of device.
 func (d *Device) ListPairings() ([]Pairing, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.ListPairingsContext(ctx)
+}
+
+// ListPairingsContext is like ListPairings but uses ctx for the request.
+func (d *Device) ListPairingsContext(ctx context.Context) ([]Pairing, error) {
 
 	pl := pairListReqPayload{
 		State:  M1,
@@ -33,7 +44,7 @@ func (d *Device) ListPairings() ([]Pairing, error) {
 		return nil, err
 	}
 
-	resp, err := d.doPost("/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -42,73 +53,29 @@ func (d *Device) ListPairings() ([]Pairing, error) {
 	}
 	res := resp.Body
 	defer res.Close()
-
-	var tag byte
-	err = binary.Read(res, binary.BigEndian, &tag)
+	all, err := io.ReadAll(res)
 	if err != nil {
 		return nil, err
 	}
-	var leng byte
-	err = binary.Read(res, binary.BigEndian, &leng)
+	m2 := pairListResPayload{}
+	err = tlv8.Unmarshal(all, &m2)
 	if err != nil {
 		return nil, err
 	}
-	val := make([]byte, leng)
-	err = binary.Read(res, binary.BigEndian, &val)
-	if err != nil {
-		return nil, err
+	if m2.Error != 0x00 {
+		return nil, TlvErrorFromCode(m2.Error)
 	}
-
-	if tag != 6 && val[0] != M2 {
-		return nil, errors.New("wrong response")
+	if m2.State != M2 {
+		return nil, fmt.Errorf("unexpected state %x, expected: %x", m2.State, M2)
 	}
 
 	var result []Pairing
-
-	var pp Pairing
-	for err == nil {
-		var tag byte
-		err = binary.Read(res, binary.BigEndian, &tag)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		var leng byte
-		err = binary.Read(res, binary.BigEndian, &leng)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-
-		if tag == 0xff {
-			// separator
-			result = append(result, pp)
-			pp = Pairing{}
-			continue
-		}
-		val := make([]byte, leng)
-		err = binary.Read(res, binary.BigEndian, &val)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		if tag == 1 {
-			pp.Id = string(val)
-		} else if tag == 3 {
-			pp.PublicKey = val
-		} else if tag == 11 {
-			pp.Permission = val[0]
-		}
-	}
-	if err == io.EOF {
-		result = append(result, pp)
-		err = nil
+	for _, pp := range m2.Pairings {
+		result = append(result, Pairing{
+			Id:         pp.Identifier,
+			PublicKey:  pp.PublicKey,
+			Permission: Permission(pp.Permission),
+		})
 	}
 
 	return result, nil
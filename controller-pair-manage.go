@@ -0,0 +1,60 @@
+package hkontroller
+
+import (
+	"context"
+	"fmt"
+)
+
+// GrantAdmin gives admin permission to paired controller.
+// Pairing should contain id and public key the controller was paired with.
+func (d *Device) GrantAdmin(p Pairing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.GrantAdminContext(ctx, p)
+}
+
+// GrantAdminContext is like GrantAdmin but uses ctx for the request.
+func (d *Device) GrantAdminContext(ctx context.Context, p Pairing) error {
+	p.Permission = PermissionAdmin
+	return d.PairAddContext(ctx, p)
+}
+
+// DemoteToUser takes admin permission away from paired controller.
+// Pairing should contain id and public key the controller was paired with.
+func (d *Device) DemoteToUser(p Pairing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.DemoteToUserContext(ctx, p)
+}
+
+// DemoteToUserContext is like DemoteToUser but uses ctx for the request.
+func (d *Device) DemoteToUserContext(ctx context.Context, p Pairing) error {
+	p.Permission = PermissionUser
+	return d.PairAddContext(ctx, p)
+}
+
+// RemoveOtherPairings removes every pairing of device except this controller.
+func (d *Device) RemoveOtherPairings() error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.RemoveOtherPairingsContext(ctx)
+}
+
+// RemoveOtherPairingsContext is like RemoveOtherPairings but uses ctx for requests.
+func (d *Device) RemoveOtherPairingsContext(ctx context.Context) error {
+	pairings, err := d.ListPairingsContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pairings {
+		if p.Id == d.controllerId {
+			continue
+		}
+		if err := d.PairRemoveContext(ctx, p.Id); err != nil {
+			return fmt.Errorf("removing pairing %s: %w", p.Id, err)
+		}
+	}
+
+	return nil
+}
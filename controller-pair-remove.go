@@ -2,13 +2,11 @@ package hkontroller
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
-	"github.com/hkontrol/hkontroller/log"
 	"github.com/hkontrol/hkontroller/tlv8"
 	"io"
 	"net/http"
-	"strconv"
 )
 
 type pairRemoveReqPayload struct {
@@ -22,7 +20,15 @@ type pairRemoveResPayload struct {
 	Error byte `tlv8:"7"`
 }
 
+// PairRemove removes pairing of controller with given id.
 func (d *Device) PairRemove(controllerId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.PairRemoveContext(ctx, controllerId)
+}
+
+// PairRemoveContext is like PairRemove but uses ctx for the request.
+func (d *Device) PairRemoveContext(ctx context.Context, controllerId string) error {
 
 	pl := pairRemoveReqPayload{
 		State:      M1,
@@ -34,7 +40,7 @@ func (d *Device) PairRemove(controllerId string) error {
 		return err
 	}
 
-	resp, err := d.doPost("/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pairings", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -49,22 +55,31 @@ func (d *Device) PairRemove(controllerId string) error {
 	}
 	m2 := pairRemoveResPayload{}
 	err = tlv8.Unmarshal(all, &m2)
-
-	if m2.Error != 0x00 {
-		return errors.New("res.err = " + strconv.FormatInt(int64(m2.Error), 10))
-	}
-
 	if err != nil {
 		return err
 	}
+	if m2.Error != 0x00 {
+		return TlvErrorFromCode(m2.Error)
+	}
 
 	return nil
 }
 
+// Unpair removes pairing of this controller from device.
 func (d *Device) Unpair() error {
-	log.Debug.Println("d.Unpair()")
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.UnpairContext(ctx)
+}
+
+// UnpairContext is like Unpair but uses ctx for the request.
+// Pairing is forgotten even if request fails.
+func (d *Device) UnpairContext(ctx context.Context) error {
+
+	err := d.PairRemoveContext(ctx, d.controllerId)
 
+	d.events.publish(Unpaired{deviceEvent{d}})
 	d.emit("unpaired")
 
-	return d.PairRemove(d.controllerId)
+	return err
 }
@@ -0,0 +1,125 @@
+package hkontroller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hkontrol/hkontroller/chacha20poly1305"
+	"github.com/hkontrol/hkontroller/hkdf"
+	"github.com/hkontrol/hkontroller/tlv8"
+	"io"
+)
+
+// resumeSessionIdLength is length of session id used by pair-resume.
+const resumeSessionIdLength = 8
+
+type pairResumeM1Payload struct {
+	Method        byte   `tlv8:"0"`
+	PublicKey     []byte `tlv8:"3"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	SessionId     []byte `tlv8:"14"`
+}
+type pairResumeM2Payload struct {
+	PublicKey     []byte `tlv8:"3"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	Error         byte   `tlv8:"7"`
+	SessionId     []byte `tlv8:"14"`
+}
+
+// pairResumeKey derives key from shared secret of previous session,
+// salted with controller public key and session id.
+func pairResumeKey(shared []byte, localPublic [32]byte, sessionId []byte, info string) ([32]byte, error) {
+	var salt []byte
+	salt = append(salt, localPublic[:]...)
+	salt = append(salt, sessionId...)
+	return hkdf.Sha512(shared, salt, []byte(info))
+}
+
+// pairResume tries to resume previous session.
+// It returns true if session was resumed.
+// If accessory can't resume session it may proceed with pair-verify,
+// then its pair-verify M2 response is returned to continue with.
+func (d *Device) pairResume(ctx context.Context, prev *session, localPublic [32]byte) (bool, *pairVerifyM2Payload, error) {
+	requestKey, err := pairResumeKey(prev.sharedSecret, localPublic, prev.resumeId, "Pair-Resume-Request-Info")
+	if err != nil {
+		return false, nil, &PairVerifyError{"M1", err}
+	}
+	_, mac, err := chacha20poly1305.EncryptAndSeal(requestKey[:], []byte("PR-Msg01"), nil, nil)
+	if err != nil {
+		return false, nil, &PairVerifyError{"M1", err}
+	}
+
+	m1 := pairResumeM1Payload{
+		Method:        MethodResume,
+		PublicKey:     localPublic[:],
+		EncryptedData: mac[:],
+		State:         M1,
+		SessionId:     prev.resumeId,
+	}
+	b, err := tlv8.Marshal(m1)
+	if err != nil {
+		return false, nil, &PairVerifyError{"M1", err}
+	}
+
+	response, err := d.doPost(ctx, "/pair-verify", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	if err != nil {
+		return false, nil, &PairVerifyError{"M1", err}
+	}
+	res := response.Body
+	defer res.Close()
+	all, err := io.ReadAll(res)
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+	m2 := pairResumeM2Payload{}
+	err = tlv8.Unmarshal(all, &m2)
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+	if m2.State != M2 {
+		return false, nil, &PairVerifyError{"M2", fmt.Errorf("unexpected state %x, expected: %x", m2.State, M2)}
+	}
+	if m2.Error != 0x00 {
+		return false, nil, &PairVerifyError{"M2", TlvErrorFromCode(m2.Error)}
+	}
+	if m2.PublicKey != nil {
+		return false, &pairVerifyM2Payload{
+			PublicKey:     m2.PublicKey,
+			EncryptedData: m2.EncryptedData,
+			State:         m2.State,
+			Error:         m2.Error,
+		}, nil
+	}
+	if len(m2.SessionId) != resumeSessionIdLength || len(m2.EncryptedData) != 16 {
+		return false, nil, &PairVerifyError{"M2", errors.New("invalid pair-resume response")}
+	}
+
+	responseKey, err := pairResumeKey(prev.sharedSecret, localPublic, m2.SessionId, "Pair-Resume-Response-Info")
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+	var responseMac [16]byte
+	copy(responseMac[:], m2.EncryptedData)
+	_, err = chacha20poly1305.DecryptAndVerify(responseKey[:], []byte("PR-Msg02"), nil, responseMac, nil)
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+
+	shared, err := pairResumeKey(prev.sharedSecret, localPublic, m2.SessionId, "Pair-Resume-Shared-Secret-Info")
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+	ss, err := newControllerSession(shared[:])
+	if err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+	ss.resumeId = m2.SessionId
+	if err := d.startSession(ctx, ss); err != nil {
+		return false, nil, &PairVerifyError{"M2", err}
+	}
+
+	return true, nil, nil
+}
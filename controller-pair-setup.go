@@ -2,6 +2,7 @@ package hkontroller
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/hkontrol/hkontroller/chacha20poly1305"
@@ -10,12 +11,18 @@ import (
 	"github.com/hkontrol/hkontroller/tlv8"
 	"io"
 	"net/http"
+	"time"
 )
 
 type pairSetupM1Payload struct {
 	Method byte `tlv8:"0"`
 	State  byte `tlv8:"6"`
 }
+type pairSetupM1FlagsPayload struct {
+	Method byte   `tlv8:"0"`
+	State  byte   `tlv8:"6"`
+	Flags  uint32 `tlv8:"19"`
+}
 type pairSetupM3Payload struct {
 	PublicKey []byte `tlv8:"3"`
 	Proof     []byte `tlv8:"4"`
@@ -32,20 +39,55 @@ type pairSetupM5EncPayload struct {
 	EncryptedData []byte `tlv8:"5"`
 }
 
-func (d *Device) pairSetupM1(pin string) (*pairSetupClientSession, error) {
+// PairSetupOptions configures pair-setup performed by PairSetupWithOptions.
+type PairSetupOptions struct {
+	// Method is MethodPair or MethodPairMFi.
+	Method byte
+	// Flags are sent with M1. Flags TLV is omitted if zero.
+	Flags PairingFlags
+}
+
+// PairSetupResult holds data presented by accessory during pair-setup.
+// Certificates and signatures are not validated against Apple authentication chain,
+// they are exposed for caller to inspect.
+type PairSetupResult struct {
+	// Flags returned by accessory in M2.
+	Flags PairingFlags
+	// M4Certificate and M4Signature are read from M4 encrypted data,
+	// sent by accessories supporting MFi authentication.
+	M4Certificate []byte
+	M4Signature   []byte
+	// M6Certificate and M6Signature are read from M6 encrypted data.
+	M6Certificate []byte
+	M6Signature   []byte
+	// AccessoryId and AccessoryLTPK are read from M6, empty for transient pair-setup.
+	AccessoryId   string
+	AccessoryLTPK []byte
+}
 
-	m1 := pairSetupM1Payload{
-		State:  M1,
-		Method: MethodPair,
+func (d *Device) pairSetupM1(ctx context.Context, pin string, opts PairSetupOptions, result *PairSetupResult) (*pairSetupClientSession, error) {
+
+	var b []byte
+	var err error
+	if opts.Flags != 0 {
+		b, err = tlv8.Marshal(pairSetupM1FlagsPayload{
+			State:  M1,
+			Method: opts.Method,
+			Flags:  uint32(opts.Flags),
+		})
+	} else {
+		b, err = tlv8.Marshal(pairSetupM1Payload{
+			State:  M1,
+			Method: opts.Method,
+		})
 	}
-	b, err := tlv8.Marshal(m1)
 	if err != nil {
 		return nil, &PairSetupError{"M1", err}
 	}
 
-	resp, err := d.doPost("/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
-		return nil, err
+		return nil, &PairSetupError{"M1", err}
 	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, &PairSetupError{"M1", fmt.Errorf("invalid status code %v", resp.StatusCode)}
@@ -72,8 +114,9 @@ func (d *Device) pairSetupM1(pin string) (*pairSetupClientSession, error) {
 		return nil, &PairSetupError{"M2", fmt.Errorf("unexpected state %x, expected: %x", state, M2)}
 	}
 	if salt == nil && remotePubk == nil && m2err != 0x00 {
-		return nil, &PairSetupError{"M2", TlvErrorFromCode(m2err)}
+		return nil, &PairSetupError{"M2", pairSetupTlvError(m2err, m2.RetryDelay)}
 	}
+	result.Flags = PairingFlags(m2.Flags)
 
 	clientSession, err := newPairSetupClientSession(salt, remotePubk, pin)
 	if err != nil {
@@ -83,7 +126,7 @@ func (d *Device) pairSetupM1(pin string) (*pairSetupClientSession, error) {
 	return clientSession, nil
 }
 
-func (d *Device) pairSetupM3(clientSession *pairSetupClientSession) error {
+func (d *Device) pairSetupM3(ctx context.Context, clientSession *pairSetupClientSession, result *PairSetupResult) error {
 
 	// m3
 	m3 := pairSetupM3Payload{
@@ -96,7 +139,7 @@ func (d *Device) pairSetupM3(clientSession *pairSetupClientSession) error {
 		return &PairSetupError{"M3", err}
 	}
 
-	resp, err := d.doPost("/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return &PairSetupError{"M3", err}
 	}
@@ -122,26 +165,64 @@ func (d *Device) pairSetupM3(clientSession *pairSetupClientSession) error {
 	serverProof := m4.Proof
 	m4err := m4.Error
 	if serverProof == nil && m4err != 0x00 {
-		return &PairSetupError{"M4", TlvErrorFromCode(m4err)}
+		return &PairSetupError{"M4", pairSetupTlvError(m4err, m4.RetryDelay)}
 	}
 	serverProofValid := clientSession.session.VerifyServerAuthenticator(serverProof)
 	if !serverProofValid {
 		return &PairSetupError{"M4", errors.New("server proof is not valid")}
 	}
 
+	err = clientSession.SetupEncryptionKey(
+		[]byte("Pair-Setup-Encrypt-Salt"),
+		[]byte("Pair-Setup-Encrypt-Info"),
+	)
+	if err != nil {
+		return &PairSetupError{"M4", err}
+	}
+
+	// MFi authenticated accessories send certificate and signature in encrypted data
+	if len(m4.EncryptedData) > 0 {
+		m4dec, err := decryptPairSetupPayload(clientSession, "PS-Msg04", m4.EncryptedData)
+		if err != nil {
+			return &PairSetupError{"M4", err}
+		}
+		result.M4Certificate = m4dec.Certificate
+		result.M4Signature = m4dec.Signature
+	}
+
 	return nil
 }
 
-func (d *Device) pairSetupM5(clientSession *pairSetupClientSession) error {
+// decryptPairSetupPayload decrypts and parses EncryptedData of pair-setup message.
+func decryptPairSetupPayload(clientSession *pairSetupClientSession, nonce string, data []byte) (*pairSetupPayload, error) {
+	if len(data) < 16 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	message := data[:(len(data) - 16)]
+	var mac [16]byte
+	copy(mac[:], data[len(message):]) // 16 byte (MAC)
 
-	err := clientSession.SetupEncryptionKey(
-		[]byte("Pair-Setup-Encrypt-Salt"),
-		[]byte("Pair-Setup-Encrypt-Info"),
+	decrypted, err := chacha20poly1305.DecryptAndVerify(
+		clientSession.EncryptionKey[:],
+		[]byte(nonce),
+		message,
+		mac,
+		nil,
 	)
 	if err != nil {
-		return &PairSetupError{"M5", err}
+		return nil, err
 	}
 
+	dec := pairSetupPayload{}
+	err = tlv8.UnmarshalReader(bytes.NewReader(decrypted), &dec)
+	if err != nil {
+		return nil, err
+	}
+	return &dec, nil
+}
+
+func (d *Device) pairSetupM5(ctx context.Context, clientSession *pairSetupClientSession, result *PairSetupResult) error {
+
 	hash, err := hkdf.Sha512(
 		clientSession.SessionKey,
 		[]byte("Pair-Setup-Controller-Sign-Salt"),
@@ -191,7 +272,7 @@ func (d *Device) pairSetupM5(clientSession *pairSetupClientSession) error {
 	if err != nil {
 		return &PairSetupError{"M5", err}
 	}
-	resp, err := d.doPost("/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	resp, err := d.doPost(ctx, "/pair-setup", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return &PairSetupError{"M5", err}
 	}
@@ -210,23 +291,10 @@ func (d *Device) pairSetupM5(clientSession *pairSetupClientSession) error {
 		return &PairSetupError{"M6", err}
 	}
 	if m6enc.EncryptedData == nil && m6enc.Error != 0x00 {
-		return &PairSetupError{"M6", TlvErrorFromCode(m6enc.Error)}
+		return &PairSetupError{"M6", pairSetupTlvError(m6enc.Error, m6enc.RetryDelay)}
 	}
 
-	message := m6enc.EncryptedData[:(len(m6enc.EncryptedData) - 16)]
-	var mac [16]byte
-	copy(mac[:], m6enc.EncryptedData[len(message):]) // 16 byte (MAC)
-
-	decrypted, err := chacha20poly1305.DecryptAndVerify(
-		clientSession.EncryptionKey[:],
-		[]byte("PS-Msg06"),
-		message,
-		mac,
-		nil,
-	)
-
-	m6dec := pairSetupPayload{}
-	err = tlv8.UnmarshalReader(bytes.NewReader(decrypted), &m6dec)
+	m6dec, err := decryptPairSetupPayload(clientSession, "PS-Msg06", m6enc.EncryptedData)
 	if err != nil {
 		return &PairSetupError{"M6", err}
 	}
@@ -236,7 +304,7 @@ func (d *Device) pairSetupM5(clientSession *pairSetupClientSession) error {
 	//	return errors.New("expected state M6")
 	//}
 	if m6dec.PublicKey == nil && m6dec.Error != 0x00 {
-		return &PairSetupError{"M6", TlvErrorFromCode(m6dec.Error)}
+		return &PairSetupError{"M6", pairSetupTlvError(m6dec.Error, m6dec.RetryDelay)}
 	}
 
 	accessoryId := m6dec.Identifier
@@ -261,36 +329,168 @@ func (d *Device) pairSetupM5(clientSession *pairSetupClientSession) error {
 		return &PairSetupError{"M6", errors.New("m6 signature is not valid")}
 	}
 
+	result.M6Certificate = m6dec.Certificate
+	result.M6Signature = accessorySignature
+	result.AccessoryId = accessoryId
+	result.AccessoryLTPK = accessoryLTPK
+
+	d.mu.Lock()
 	d.pairing.Name = d.Name
 	d.pairing.Id = accessoryId
 	d.pairing.PublicKey = accessoryLTPK
+	d.pairing.Address = d.staticAddress
+	d.mu.Unlock()
 
 	return nil
 }
 
+// PairSetup performs /pair-setup with given setup code.
 func (d *Device) PairSetup(pin string) error {
+	return d.PairSetupContext(context.Background(), pin)
+}
 
-	if d.cc == nil || d.cc.closed {
-		err := d.connect()
-		if err != nil {
-			return err
-		}
+// PairSetupContext is like PairSetup but uses ctx for connection and requests.
+func (d *Device) PairSetupContext(ctx context.Context, pin string) error {
+	_, err := d.PairSetupWithOptions(ctx, pin, PairSetupOptions{Method: MethodPair})
+	return err
+}
+
+// PairSetupWithOptions performs /pair-setup with given setup code, method and flags.
+//
+// With PairingFlagTransient pair-setup ends after M4: no pairing is stored,
+// connection is upgraded to encrypted session with keys derived from SRP shared secret
+// and device becomes verified, but not paired.
+// Combine it with PairingFlagSplit to ask accessory to keep SRP verifier for later
+// pair-setup with PairingFlagSplit.
+func (d *Device) PairSetupWithOptions(ctx context.Context, pin string, opts PairSetupOptions) (*PairSetupResult, error) {
+	d.connMu.Lock()
+	result, err := d.pairSetup(ctx, pin, opts)
+	d.connMu.Unlock()
+	if err != nil {
+		d.logger.Debug("pair-setup failed", pairingStepAttr(err), "err", err)
+		return nil, err
+	}
+	d.logger.Debug("pair-setup done", "method", opts.Method, "flags", opts.Flags)
+	return result, nil
+}
+
+func (d *Device) pairSetup(ctx context.Context, pin string, opts PairSetupOptions) (*PairSetupResult, error) {
+	if opts.Method != MethodPair && opts.Method != MethodPairMFi {
+		return nil, &PairSetupError{"M1", fmt.Errorf("unsupported pair-setup method %d", opts.Method)}
+	}
+
+	if err := d.ensureConnected(ctx); err != nil {
+		return nil, err
 	}
 
-	clientSession, err := d.pairSetupM1(pin)
+	result := &PairSetupResult{}
+
+	clientSession, err := d.pairSetupM1(ctx, pin, opts, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = d.pairSetupM3(clientSession)
+	err = d.pairSetupM3(ctx, clientSession, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = d.pairSetupM5(clientSession)
+
+	if opts.Flags&PairingFlagTransient != 0 {
+		ss, err := newControllerSession(clientSession.SessionKey)
+		if err != nil {
+			return nil, &PairSetupError{"M4", err}
+		}
+		// there is no pairing to resume session with
+		ss.resumeId = nil
+		if err := d.startSession(ctx, ss); err != nil {
+			return nil, &PairSetupError{"M4", err}
+		}
+		return result, nil
+	}
+
+	err = d.pairSetupM5(ctx, clientSession, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	d.mu.Lock()
 	d.paired = true
 	d.verified = false
+	// session of previous pairing can't be resumed
+	d.ss = nil
+	d.mu.Unlock()
+	d.events.publish(Paired{deviceEvent{d}})
 	d.emit("paired")
-	return nil
+	return result, nil
+}
+
+// pairSetupTlvError returns *RetryDelayError for backoff error code
+// and *TlvError for others.
+func pairSetupTlvError(code byte, retryDelay uint16) error {
+	err := TlvErrorFromCode(code)
+	if code == TlvErrorBackoff.Code {
+		return &RetryDelayError{
+			RetryDelay: time.Duration(retryDelay) * time.Second,
+			err:        err,
+		}
+	}
+	return err
+}
+
+// PairSetupRetryPolicy defines how PairSetupWithRetry handles temporary errors.
+type PairSetupRetryPolicy struct {
+	// MaxAttempts limits number of pair-setup attempts, unlimited if zero.
+	MaxAttempts int
+	// BusyDelay is wait time after TlvErrorBusy or TlvErrorBackoff without retry delay.
+	// Default is 5 seconds.
+	BusyDelay time.Duration
+}
+
+// PairSetupWithRetry performs pair-setup and repeats it when accessory
+// responds with TlvErrorBackoff or TlvErrorBusy,
+// waiting retry delay requested by accessory.
+// It stops on TlvErrorMaxTries, as accessory won't accept setup code anymore,
+// on any other error, when MaxAttempts is reached or ctx is done.
+func (d *Device) PairSetupWithRetry(ctx context.Context, pin string, policy PairSetupRetryPolicy) error {
+	busyDelay := policy.BusyDelay
+	if busyDelay <= 0 {
+		busyDelay = 5 * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := d.PairSetupContext(ctx, pin)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var delay time.Duration
+		var retryErr *RetryDelayError
+		if errors.As(err, &retryErr) {
+			delay = retryErr.RetryDelay
+			if delay <= 0 {
+				delay = busyDelay
+			}
+		} else if errors.Is(err, &TlvErrorBusy) {
+			delay = busyDelay
+		} else {
+			// TlvErrorMaxTries, authentication or connection errors
+			return err
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return fmt.Errorf("pair-setup failed after %d attempts: %w", attempt, err)
+		}
+
+		d.logger.Debug("pair-setup failed, retrying", pairingStepAttr(err), "attempt", attempt, "retry", delay, "err", err)
+
+		// start next attempt with new connection
+		d.close(err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
 }
@@ -2,6 +2,7 @@ package hkontroller
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/hkontrol/hkontroller/chacha20poly1305"
@@ -17,6 +18,12 @@ type pairVerifyM1Payload struct {
 	State     byte   `tlv8:"6"`
 	PublicKey []byte `tlv8:"3"`
 }
+type pairVerifyM2Payload struct {
+	PublicKey     []byte `tlv8:"3"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	Error         byte   `tlv8:"7"`
+}
 type pairVerifyM3RawPayload struct {
 	Identifier string `tlv8:"1"`
 	Signature  []byte `tlv8:"10"`
@@ -26,23 +33,70 @@ type pairVerifyM3EncPayload struct {
 	EncryptedData []byte `tlv8:"5"`
 }
 
-// PairVerify
+// PairVerify establishes encrypted session with paired device.
 func (d *Device) PairVerify() error {
-	if !d.paired {
+	return d.PairVerifyContext(context.Background())
+}
+
+// PairVerifyContext is like PairVerify but uses ctx for connection and requests.
+func (d *Device) PairVerifyContext(ctx context.Context) error {
+	d.connMu.Lock()
+	err := d.pairVerify(ctx)
+	d.connMu.Unlock()
+	if err != nil {
+		d.logger.Debug("pair-verify failed", pairingStepAttr(err), "err", err)
+		return err
+	}
+	d.logger.Debug("pair-verify done")
+	return nil
+}
+
+func (d *Device) pairVerify(ctx context.Context) error {
+	if !d.IsPaired() {
 		return errors.New("pair device before verifying")
 	}
-	if d.verified {
+	if d.IsVerified() {
 		d.close(errors.New("reconnect"))
 	}
-	if d.cc == nil || d.cc.closed {
-		err := d.connect()
+	if err := d.ensureConnected(ctx); err != nil {
+		return err
+	}
+
+	localPublic, localPrivate := curve25519.GenerateKeyPair()
+
+	// resume data of previous session is valid for single attempt
+	d.mu.Lock()
+	prev := d.ss
+	d.ss = nil
+	d.mu.Unlock()
+
+	var m2 *pairVerifyM2Payload
+	if prev != nil && len(prev.resumeId) > 0 {
+		resumed, verifyM2, err := d.pairResume(ctx, prev, localPublic)
+		if err == nil && resumed {
+			return nil
+		}
+		if err != nil {
+			d.logger.Debug("pair-resume failed, falling back to pair-verify", pairingStepAttr(err), "err", err)
+			if err := d.ensureConnected(ctx); err != nil {
+				return err
+			}
+		}
+		// accessory may continue with pair-verify M2 if it can't resume session
+		m2 = verifyM2
+	}
+	if m2 == nil {
+		var err error
+		m2, err = d.pairVerifyM1(ctx, localPublic)
 		if err != nil {
 			return err
 		}
 	}
 
-	localPublic, localPrivate := curve25519.GenerateKeyPair()
+	return d.pairVerifyM3(ctx, localPublic, localPrivate, m2)
+}
 
+func (d *Device) pairVerifyM1(ctx context.Context, localPublic [32]byte) (*pairVerifyM2Payload, error) {
 	m1 := pairVerifyM1Payload{
 		Method:    0,
 		State:     M1,
@@ -50,31 +104,38 @@ func (d *Device) PairVerify() error {
 	}
 	b, err := tlv8.Marshal(m1)
 	if err != nil {
-		return &PairVerifyError{"M1", err}
+		return nil, &PairVerifyError{"M1", err}
 	}
 
 	// send req
-	response, err := d.doPost("/pair-verify", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	response, err := d.doPost(ctx, "/pair-verify", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
-		return &PairVerifyError{"M1", err}
+		return nil, &PairVerifyError{"M1", err}
 	}
 	res := response.Body
 	defer res.Close()
 	all, err := io.ReadAll(res)
 	if err != nil {
-		return &PairVerifyError{"M2", err}
+		return nil, &PairVerifyError{"M2", err}
 	}
-	m2 := pairSetupPayload{}
+	m2 := pairVerifyM2Payload{}
 	err = tlv8.Unmarshal(all, &m2)
 	if err != nil {
-		return &PairVerifyError{"M2", err}
+		return nil, &PairVerifyError{"M2", err}
 	}
+	return &m2, nil
+}
+
+func (d *Device) pairVerifyM3(ctx context.Context, localPublic, localPrivate [32]byte, m2 *pairVerifyM2Payload) error {
 	if m2.State != M2 {
 		return &PairVerifyError{"M2", fmt.Errorf("unexpected state %x, expected: %x", m2.State, M2)}
 	}
-	if m2.PublicKey == nil || m2.EncryptedData == nil || m2.Error != 0x00 {
+	if m2.Error != 0x00 {
 		return &PairVerifyError{"M2", TlvErrorFromCode(m2.Error)}
 	}
+	if m2.PublicKey == nil || m2.EncryptedData == nil {
+		return &PairVerifyError{"M2", errors.New("incomplete response")}
+	}
 	if len(m2.PublicKey) != 32 {
 		return &PairVerifyError{"M2", errors.New("wrong remote localPublic key length")}
 	}
@@ -105,7 +166,7 @@ func (d *Device) PairVerify() error {
 		nil,
 	)
 	if err != nil {
-		return &PairVerifyError{"M2", err}
+		return &PairVerifyError{"M2", fmt.Errorf("%w: %v", ErrAccessoryAuthentication, err)}
 	}
 	m2dec := pairSetupPayload{}
 	err = tlv8.UnmarshalReader(bytes.NewReader(decryptedBytes), &m2dec)
@@ -122,11 +183,11 @@ func (d *Device) PairVerify() error {
 	material = append(material, m2dec.Identifier...)
 	material = append(material, localPublic[:]...)
 
-	ltpk := d.pairing.PublicKey
+	ltpk := d.GetPairingInfo().PublicKey
 
 	sigValid := ed25519.ValidateSignature(ltpk, material, m2dec.Signature)
 	if !sigValid {
-		return &PairVerifyError{"M2", errors.New("signature invalid")}
+		return &PairVerifyError{"M2", fmt.Errorf("%w: signature invalid", ErrAccessoryAuthentication)}
 	}
 
 	// ----- M3 ------
@@ -164,19 +225,19 @@ func (d *Device) PairVerify() error {
 		State:         M3,
 		EncryptedData: append(encryptedBytes, mac[:]...),
 	}
-	b, err = tlv8.Marshal(m5enc)
+	b, err := tlv8.Marshal(m5enc)
 	if err != nil {
 		return &PairVerifyError{"M3", err}
 	}
 
-	response, err = d.doPost("/pair-verify", HTTPContentTypePairingTLV8, bytes.NewReader(b))
+	response, err := d.doPost(ctx, "/pair-verify", HTTPContentTypePairingTLV8, bytes.NewReader(b))
 	if err != nil {
 		return &PairVerifyError{"M4", err}
 	}
-	res = response.Body
+	res := response.Body
 
 	defer res.Close()
-	all, err = io.ReadAll(res)
+	all, err := io.ReadAll(res)
 	if err != nil {
 		return &PairVerifyError{"M4", err}
 	}
@@ -190,135 +251,44 @@ func (d *Device) PairVerify() error {
 		return &PairVerifyError{"M4", TlvErrorFromCode(m4.Error)}
 	}
 
-	ss, err := newControllerSession(sharedKey, d)
+	ss, err := newControllerSession(sharedKey[:])
 	if err != nil {
 		return &PairVerifyError{"M4", err}
 	}
+	if err := d.startSession(ctx, ss); err != nil {
+		return &PairVerifyError{"M4", err}
+	}
+
+	return nil
+}
+
+// startSession upgrades connection to encrypted one,
+// starts reading responses and events in background and emits "verified".
+// It fails if connection is closed meanwhile.
+func (d *Device) startSession(ctx context.Context, ss *session) error {
+	d.mu.Lock()
+	cc := d.cc
+	if cc == nil || cc.isClosed() {
+		d.mu.Unlock()
+		return errConnectionClosed
+	}
 	d.ss = ss
-	d.cc.UpgradeEnc(ss)
+	cc.UpgradeEnc(ss)
 	d.verified = true
+	d.mu.Unlock()
 
-	d.startBackgroundRead()
+	d.startBackgroundRead(cc)
 
-	d.emit("verified")
+	if err := d.restoreSubscriptions(ctx); err != nil {
+		d.logger.Warn("restoring event subscriptions failed", "err", err)
+	}
+	// mirror needs accessories of every session,
+	// values could change while device was not connected
+	if d.mirror != nil || d.configChanged() {
+		go d.refetchAccessories()
+	}
 
+	d.events.publish(Verified{deviceEvent{d}})
+	d.emit("verified")
 	return nil
 }
-
-// PairSetupAndVerify first setup pairing if was not set before
-// then establish encrypted connection
-// that should automatically reconnect in case of failure.
-// If pin argument is empty pair-setup step is skipped.
-//func (d *Device) PairSetupAndVerify(ctx context.Context, pin string, retryTimeout time.Duration) error {
-//	var err error
-//
-//	if pin != "" {
-//		// pair-setup should be done in any case
-//		if !d.paired {
-//			err = d.PairSetup(pin)
-//		}
-//		if err != nil {
-//			return err
-//		}
-//	}
-//
-//	// then encrypted channel should be persisted
-//	go d.pairVerifyPersist(ctx, retryTimeout)
-//
-//	verifiedEv := d.OnVerified()
-//	unpairedEv := d.OnUnpaired()
-//	lostEv := d.OnLost()
-//	defer func() {
-//		d.OffVerified(verifiedEv)
-//		d.OffUnpaired(unpairedEv)
-//		d.OffLost(lostEv)
-//	}()
-//	select {
-//	case <-verifiedEv:
-//		return nil
-//	case <-lostEv:
-//		return errors.New("device lost")
-//	case <-unpairedEv:
-//		return errors.New("unpaired")
-//	}
-//}
-
-// pairVerifyPersist establish encrypted connection with auto-reconnect.
-// Connection broke if device is unpaired. May be cancelled by context as well.
-//func (d *Device) pairVerifyPersist(ctx context.Context, retryTimeout time.Duration) {
-//	newCtx, cancel := context.WithCancel(ctx)
-//	d.CancelPersistConnection = cancel
-//	errorEv := d.OnError()
-//	unpairedEv := d.OnUnpaired()
-//	closedEv := d.OnClose()
-//	lostEv := d.OnLost() // mdns lost
-//	defer func() {
-//		d.OffError(errorEv)
-//		d.OffClose(closedEv)
-//		d.OffUnpaired(unpairedEv)
-//		d.OffLost(lostEv)
-//	}()
-//	for {
-//		go func() {
-//			if !d.discovered || d.dnssdBrowseEntry == nil {
-//				//d.emit("lost")
-//				return
-//			}
-//			if d.paired && !d.verified {
-//				err := d.PairVerify()
-//				if err != nil {
-//					// just emit error in this case
-//					// sometimes error may occur if connection was broken, etc
-//					// so no need to unpair
-//					d.emit("error", err)
-//					return
-//				}
-//			} else if d.paired && d.verified {
-//				// to catch later
-//				d.emit("verified")
-//			}
-//		}()
-//
-//		// catch events
-//		select {
-//		case ev := <-errorEv:
-//			log.Debug.Println("error event")
-//			if len(ev.Args) > 0 {
-//				// check error - if it's protocol error, e.g. invalid signature, then return err
-//				if err, ok := ev.Args[0].(error); ok {
-//					var pSetupErr *PairSetupError
-//					var pVerifyErr *PairVerifyError
-//					if errors.As(err, &pSetupErr) || errors.As(err, &pVerifyErr) {
-//						d.close(err)
-//						return
-//					}
-//				}
-//			}
-//			time.Sleep(retryTimeout)
-//			// reconnect in new iteration
-//			continue
-//		case <-closedEv:
-//			log.Debug.Println("close event")
-//			select {
-//			case <-time.After(retryTimeout):
-//				// connection was closed, try to reconnect
-//				continue
-//			case <-lostEv:
-//				// connection was closed and device is not advertising itself no more
-//				log.Debug.Println("lost event")
-//				d.close(errors.New("lost event"))
-//				return
-//			}
-//		case <-unpairedEv:
-//			d.CancelPersistConnection = nil
-//			log.Debug.Println("unpaired event")
-//			// in this case we don't need connection anymore
-//			d.close(errors.New("unpaired event"))
-//			return
-//		case <-newCtx.Done():
-//			d.CancelPersistConnection = nil
-//			d.close(newCtx.Err())
-//			return
-//		}
-//	}
-//}
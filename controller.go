@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"sync"
 
 	"github.com/hkontrol/dnssd"
 	_ "github.com/hkontrol/dnssd/log"
+	"github.com/hkontrol/hkontroller/setuppayload"
 )
 
 type pairSetupPayload struct {
@@ -19,14 +22,18 @@ type pairSetupPayload struct {
 	EncryptedData []byte `tlv8:"5"`
 	State         byte   `tlv8:"6"`
 	Error         byte   `tlv8:"7"`
-	RetryDelay    byte   `tlv8:"8"`
+	RetryDelay    uint16 `tlv8:"8"`
 	Certificate   []byte `tlv8:"9"`
 	Signature     []byte `tlv8:"10"`
 	Permissions   byte   `tlv8:"11"`
 	FragmentData  []byte `tlv8:"13"`
 	FragmentLast  []byte `tlv8:"14"`
+	Flags         uint32 `tlv8:"19"`
 }
 
+// Controller discovers, pairs and keeps track of devices.
+// It is safe for concurrent use, devices map is guarded by mu.
+// Lock order is Controller.mu, then Device.mu.
 type Controller struct {
 	name            string
 	uuid            string
@@ -34,17 +41,40 @@ type Controller struct {
 	cancelDiscovery context.CancelFunc
 	devices         map[string]*Device
 
-	st *storer
+	st     *storer
+	logger *slog.Logger
+	events *eventBus
+	mirror *stateMirror // nil unless WithStateMirror is used
 
 	localLTKP []byte
 	localLTSK []byte
 }
 
-func NewController(store Store, name string) (*Controller, error) {
+// ControllerOption configures Controller created by NewController.
+type ControllerOption func(*Controller)
+
+// WithLogger sets logger of controller and its devices.
+// Records of device have "device" attribute with device name.
+// Nothing is logged by default.
+func WithLogger(logger *slog.Logger) ControllerOption {
+	return func(c *Controller) {
+		c.logger = logger
+	}
+}
+
+// NewController creates controller with keypair loaded from store or generated on first use.
+// Error wraps ErrNotEncrypted if store is encrypted but keypair was saved in plain,
+// or ErrWrongKey if keypair was encrypted with other key.
+func NewController(store Store, name string, opts ...ControllerOption) (*Controller, error) {
 
 	st := storer{store}
 
 	keypair, err := st.KeyPair()
+	if errors.Is(err, ErrWrongKey) || errors.Is(err, ErrNotEncrypted) {
+		// keypair exists but is not readable,
+		// replacing it would break all pairings
+		return nil, fmt.Errorf("reading keypair failed: %w", err)
+	}
 	if err != nil {
 		keypair, err = generateKeyPair()
 		if err != nil {
@@ -55,61 +85,107 @@ func NewController(store Store, name string) (*Controller, error) {
 		}
 	}
 
-	return &Controller{
+	c := &Controller{
 		name:      name,
 		mu:        sync.Mutex{},
 		devices:   make(map[string]*Device),
 		st:        &st,
+		logger:    discardLogger,
+		events:    newEventBus(),
 		localLTKP: keypair.Public,
 		localLTSK: keypair.Private,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.logger == nil {
+		c.logger = discardLogger
+	}
+
+	return c, nil
 }
 
-func (c *Controller) putDevice(dd *Device) {
+// putDevice adds device unless device with the same name exists.
+// It returns device stored in controller.
+func (c *Controller) putDevice(dd *Device) *Device {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if existing, ok := c.devices[dd.Name]; ok {
+		return existing
+	}
+	dd.events = c.events
+	dd.mirror = c.mirror
 	c.devices[dd.Name] = dd
 
 	devPairedCh := dd.OnPaired()
 	go func() {
 		for range devPairedCh {
-			fmt.Println("save pairing: ", dd.pairing)
-			c.st.SavePairing(dd.pairing)
+			p := dd.GetPairingInfo()
+			if err := c.st.SavePairing(p); err != nil {
+				dd.logger.Error("saving pairing failed", "err", err)
+			} else {
+				dd.logger.Info("pairing saved", "id", p.Id)
+			}
+			dd.updateKnownAddress()
+			c.saveKnownAddress(dd)
 		}
 	}()
 
 	devUnpairedCh := dd.OnUnpaired()
 	go func() {
 		for range devUnpairedCh {
-			c.st.DeletePairing(dd.pairing.Id)
-			dd.pairing = Pairing{}
-			dd.paired = false
-			dd.verified = false
-
-			c.mu.Lock()
+			p := dd.GetPairingInfo()
+			if err := c.st.DeletePairing(p.Id); err != nil {
+				dd.logger.Error("deleting pairing failed", "err", err)
+			}
+			c.st.DeleteKnownAddress(p.Id)
+			c.mirror.remove(dd.Name)
+			dd.forgetPairing()
 			dd.close(errors.New("device unpaired"))
-			// if not paired and not discovered,
+			dd.dropSubscriptions()
+
+			// if not paired, not discovered and has no static address,
 			// then it should not present anymore
-			if !dd.IsDiscovered() {
+			c.mu.Lock()
+			remove := !dd.IsDiscovered() && dd.StaticAddress() == "" && c.devices[dd.Name] == dd
+			if remove {
 				delete(c.devices, dd.Name)
-				dd.offAllTopics()
 			}
 			c.mu.Unlock()
+			if remove {
+				dd.offAllTopics()
+			}
 		}
 	}()
 	devLostCh := dd.OnLost()
 	go func() {
 		for range devLostCh {
-			if !dd.IsPaired() {
-				// if lost and not paired,
-				// then it should not present anymore
-				c.mu.Lock()
+			// if lost, not paired and has no static address,
+			// then it should not present anymore
+			c.mu.Lock()
+			remove := !dd.IsPaired() && dd.StaticAddress() == "" && c.devices[dd.Name] == dd
+			if remove {
 				delete(c.devices, dd.Name)
-				c.mu.Unlock()
+			}
+			c.mu.Unlock()
+			if remove {
 				dd.offAllTopics()
 			}
 		}
 	}()
+
+	return dd
+}
+
+// saveKnownAddress saves last known address of paired device.
+func (c *Controller) saveKnownAddress(dd *Device) {
+	a, ok := dd.KnownAddress()
+	if !ok {
+		return
+	}
+	if err := c.st.SaveKnownAddress(dd.GetPairingInfo().Id, a); err != nil {
+		dd.logger.Warn("saving known address failed", "err", err)
+	}
 }
 
 func (c *Controller) getDevice(id string) *Device {
@@ -128,17 +204,9 @@ func (c *Controller) StartDiscoveryWithContext(ctx context.Context) (<-chan *Dev
 	lostCh := make(chan *Device)
 
 	addFn := func(e dnssd.BrowseEntry) {
-		name := e.Name
-
-		dd := c.getDevice(e.Name)
-		if dd == nil {
-			// not exist - init one
-			dd = newDevice(&e, name, c.name, c.localLTKP, c.localLTSK)
-			c.putDevice(dd)
-		}
-		c.devices[name].mergeDnssdEntry(e)
-
-		dd.discovered = true
+		dd := c.mergeBrowseEntry(e)
+		dd.events.publish(DeviceDiscovered{deviceEvent{dd}})
+		dd.emit("discover")
 		discoverCh <- dd
 	}
 
@@ -148,8 +216,8 @@ func (c *Controller) StartDiscoveryWithContext(ctx context.Context) (<-chan *Dev
 		dd := c.getDevice(id)
 
 		if dd != nil {
-			dd.discovered = false
-			dd.setDnssdEntry(nil)
+			dd.setDiscovered(false)
+			dd.events.publish(DeviceLost{deviceEvent{dd}})
 			dd.emit("lost")
 			dd.close(errors.New("device lost from mdns"))
 			lostCh <- dd
@@ -164,7 +232,9 @@ func (c *Controller) StartDiscoveryWithContext(ctx context.Context) (<-chan *Dev
 		for {
 			newCtx, cancel := context.WithCancel(ctx)
 			defer cancel()
+			c.mu.Lock()
 			c.cancelDiscovery = cancel
+			c.mu.Unlock()
 			if err := dnssd.LookupType(newCtx, "_hap._tcp.local.", addFn, rmvFn); err != nil {
 				if errors.Is(err, context.Canceled) {
 					return
@@ -181,9 +251,44 @@ func (c *Controller) StartDiscovery() (<-chan *Device, <-chan *Device) {
 }
 
 func (c *Controller) StopDiscovery() {
-	if c.cancelDiscovery != nil {
-		c.cancelDiscovery()
+	c.mu.Lock()
+	cancel := c.cancelDiscovery
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// AddDevice adds device resolved without mdns browsing, e.g. by other
+// service discovery or hktest.Server. Device is treated as discovered.
+// Accessories are fetched again if config number has changed, as for discovered device.
+func (c *Controller) AddDevice(e dnssd.BrowseEntry) *Device {
+	return c.mergeBrowseEntry(e)
+}
+
+// mergeBrowseEntry creates or updates device from resolved entry
+// and marks it discovered.
+func (c *Controller) mergeBrowseEntry(e dnssd.BrowseEntry) *Device {
+	dd := c.getDevice(e.Name)
+	if dd == nil {
+		// not exist - init one
+		dd = c.putDevice(newDevice(&e, e.Name, c.name, c.localLTKP, c.localLTSK, c.logger))
+	}
+	prevInfo := dd.Info()
+	dd.mergeDnssdEntry(e)
+	if prevInfo.ConfigNumber != 0 &&
+		prevInfo.ConfigNumber != dd.Info().ConfigNumber && dd.IsVerified() {
+		// accessory database changed
+		go dd.refetchAccessories()
+	}
+
+	// keep saved address in sync with discovered one
+	if dd.updateKnownAddress() && dd.IsPaired() {
+		c.saveKnownAddress(dd)
 	}
+
+	dd.setDiscovered(true)
+	return dd
 }
 
 // GetAllDevices returns list of all devices loaded or discovered by controller.
@@ -207,7 +312,7 @@ func (c *Controller) GetPairedDevices() []*Device {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for _, d := range c.devices {
-		if d.paired {
+		if d.IsPaired() {
 			result = append(result, d)
 		}
 	}
@@ -222,7 +327,7 @@ func (c *Controller) GetVerifiedDevices() []*Device {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for _, d := range c.devices {
-		if d.verified {
+		if d.IsVerified() {
 			result = append(result, d)
 		}
 	}
@@ -235,16 +340,56 @@ func (c *Controller) LoadPairings() error {
 	pp := c.st.Pairings()
 	for _, p := range pp {
 		name := p.Name
-		dd := newDevice(nil, name, c.name, c.localLTKP, c.localLTSK)
-		dd.pairing = p
-		dd.paired = true
+		var known *KnownAddress
+		if a, err := c.st.KnownAddress(p.Id); err == nil {
+			// reachable before discovered again
+			known = &a
+		}
 
-		c.putDevice(dd)
+		dd := c.putDevice(newDevice(nil, name, c.name, c.localLTKP, c.localLTSK, c.logger))
+		dd.loadPairing(p, known)
 	}
 
 	return nil
 }
 
+// AddStaticDevice adds device reachable at host:port address,
+// so it can be paired and verified without mdns discovery.
+// Address of already known device is replaced.
+// For paired device address is saved with pairing,
+// so it is restored by LoadPairings.
+func (c *Controller) AddStaticDevice(name string, address string) (*Device, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", address, err)
+	}
+
+	dd := c.getDevice(name)
+	if dd == nil {
+		dd = c.putDevice(newDevice(nil, name, c.name, c.localLTKP, c.localLTSK, c.logger))
+	}
+
+	if p, paired := dd.setStaticAddress(address); paired {
+		if err := c.st.SavePairing(p); err != nil {
+			return dd, err
+		}
+	}
+
+	return dd, nil
+}
+
 func (c *Controller) GetDevice(deviceName string) *Device {
 	return c.getDevice(deviceName)
 }
+
+// FindDeviceBySetupPayload returns discovered device matching scanned setup payload
+// or nil if there is no such device.
+func (c *Controller) FindDeviceBySetupPayload(p setuppayload.Payload) *Device {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.devices {
+		if d.MatchesSetupPayload(p) {
+			return d
+		}
+	}
+	return nil
+}
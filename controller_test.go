@@ -0,0 +1,163 @@
+package hkontroller
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/hkontrol/dnssd"
+)
+
+func TestKnownAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	st := NewMemStore()
+	c, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDevice(nil, "Lamp", c.name, c.localLTKP, c.localLTSK, c.logger)
+	d.mergeDnssdEntry(dnssd.BrowseEntry{
+		Name: "Lamp",
+		IPs:  []net.IP{addr.IP},
+		Port: addr.Port,
+	})
+	if is, want := d.updateKnownAddress(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	// same entry is not saved again
+	d.mergeDnssdEntry(dnssd.BrowseEntry{Name: "Lamp", Port: addr.Port})
+	if is, want := d.updateKnownAddress(), false; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	d.pairing = Pairing{Name: "Lamp", Id: "AA:BB:CC:DD:EE:FF"}
+	if err := c.st.SavePairing(d.pairing); err != nil {
+		t.Fatal(err)
+	}
+	c.saveKnownAddress(d)
+
+	c2, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.LoadPairings(); err != nil {
+		t.Fatal(err)
+	}
+	d2 := c2.GetDevice("Lamp")
+	if d2 == nil {
+		t.Fatal("device is not loaded")
+	}
+	a, ok := d2.KnownAddress()
+	if !ok {
+		t.Fatal("known address is not loaded")
+	}
+	if is, want := a.Port, addr.Port; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	// not discovered device is reachable at known address
+	if err := d2.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d2.Close()
+}
+
+func TestMergeDnssdEntryReplacesIPs(t *testing.T) {
+	d := newDevice(nil, "Lamp", "controller", nil, nil, slog.Default())
+	d.mergeDnssdEntry(dnssd.BrowseEntry{
+		Name: "Lamp",
+		IPs:  []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fe80::1")},
+		Port: 8080,
+	})
+	d.mergeDnssdEntry(dnssd.BrowseEntry{
+		Name: "Lamp",
+		IPs:  []net.IP{net.ParseIP("192.168.1.20")},
+	})
+	if is, want := d.updateKnownAddress(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	a, _ := d.KnownAddress()
+	if is, want := len(a.IPs), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := a.IPs[0].String(), "192.168.1.20"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := a.Port, 8080; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestConnectPrefersStaticAddress(t *testing.T) {
+	static, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer static.Close()
+	known, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer known.Close()
+	knownAddr := known.Addr().(*net.TCPAddr)
+
+	d := newDevice(nil, "Lamp", "controller", nil, nil, slog.Default())
+	d.loadPairing(Pairing{Name: "Lamp", Address: static.Addr().String()}, &KnownAddress{
+		IPs:  []net.IP{knownAddr.IP},
+		Port: knownAddr.Port,
+	})
+	if err := d.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d.cc.RemoteAddr().String(), static.Addr().String(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	// known address is used when static one is not reachable
+	static.Close()
+	if err := d.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d.cc.RemoteAddr().String(), known.Addr().String(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	d.Close()
+}
+
+func TestPairSetupConnectionError(t *testing.T) {
+	// accessory closing connection before response
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := newDevice(nil, "Lamp", "controller", nil, nil, slog.Default())
+	d.setStaticAddress(ln.Addr().String())
+	err = d.PairSetup("031-45-154")
+	var setupErr *PairSetupError
+	if !errors.As(err, &setupErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if is, want := setupErr.Step, "M1"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
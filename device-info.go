@@ -0,0 +1,174 @@
+package hkontroller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hkontrol/hkontroller/setuppayload"
+)
+
+// AccessoryCategory is accessory category advertised with "ci" TXT key.
+type AccessoryCategory uint16
+
+const (
+	Category_Other              AccessoryCategory = 1
+	Category_Bridge             AccessoryCategory = 2
+	Category_Fan                AccessoryCategory = 3
+	Category_GarageDoorOpener   AccessoryCategory = 4
+	Category_Lightbulb          AccessoryCategory = 5
+	Category_DoorLock           AccessoryCategory = 6
+	Category_Outlet             AccessoryCategory = 7
+	Category_Switch             AccessoryCategory = 8
+	Category_Thermostat         AccessoryCategory = 9
+	Category_Sensor             AccessoryCategory = 10
+	Category_SecuritySystem     AccessoryCategory = 11
+	Category_Door               AccessoryCategory = 12
+	Category_Window             AccessoryCategory = 13
+	Category_WindowCovering     AccessoryCategory = 14
+	Category_ProgrammableSwitch AccessoryCategory = 15
+	Category_RangeExtender      AccessoryCategory = 16
+	Category_IPCamera           AccessoryCategory = 17
+	Category_VideoDoorbell      AccessoryCategory = 18
+	Category_AirPurifier        AccessoryCategory = 19
+	Category_Heater             AccessoryCategory = 20
+	Category_AirConditioner     AccessoryCategory = 21
+	Category_Humidifier         AccessoryCategory = 22
+	Category_Dehumidifier       AccessoryCategory = 23
+	Category_AppleTV            AccessoryCategory = 24
+	Category_HomePod            AccessoryCategory = 25
+	Category_Speaker            AccessoryCategory = 26
+	Category_AirPort            AccessoryCategory = 27
+	Category_Sprinkler          AccessoryCategory = 28
+	Category_Faucet             AccessoryCategory = 29
+	Category_ShowerHead         AccessoryCategory = 30
+	Category_Television         AccessoryCategory = 31
+	Category_TargetController   AccessoryCategory = 32
+	Category_Router             AccessoryCategory = 33
+	Category_AudioReceiver      AccessoryCategory = 34
+	Category_TVSetTopBox        AccessoryCategory = 35
+	Category_TVStreamingStick   AccessoryCategory = 36
+)
+
+var categoryNames = map[AccessoryCategory]string{
+	Category_Other:              "Other",
+	Category_Bridge:             "Bridge",
+	Category_Fan:                "Fan",
+	Category_GarageDoorOpener:   "GarageDoorOpener",
+	Category_Lightbulb:          "Lightbulb",
+	Category_DoorLock:           "DoorLock",
+	Category_Outlet:             "Outlet",
+	Category_Switch:             "Switch",
+	Category_Thermostat:         "Thermostat",
+	Category_Sensor:             "Sensor",
+	Category_SecuritySystem:     "SecuritySystem",
+	Category_Door:               "Door",
+	Category_Window:             "Window",
+	Category_WindowCovering:     "WindowCovering",
+	Category_ProgrammableSwitch: "ProgrammableSwitch",
+	Category_RangeExtender:      "RangeExtender",
+	Category_IPCamera:           "IPCamera",
+	Category_VideoDoorbell:      "VideoDoorbell",
+	Category_AirPurifier:        "AirPurifier",
+	Category_Heater:             "Heater",
+	Category_AirConditioner:     "AirConditioner",
+	Category_Humidifier:         "Humidifier",
+	Category_Dehumidifier:       "Dehumidifier",
+	Category_AppleTV:            "AppleTV",
+	Category_HomePod:            "HomePod",
+	Category_Speaker:            "Speaker",
+	Category_AirPort:            "AirPort",
+	Category_Sprinkler:          "Sprinkler",
+	Category_Faucet:             "Faucet",
+	Category_ShowerHead:         "ShowerHead",
+	Category_Television:         "Television",
+	Category_TargetController:   "TargetController",
+	Category_Router:             "Router",
+	Category_AudioReceiver:      "AudioReceiver",
+	Category_TVSetTopBox:        "TVSetTopBox",
+	Category_TVStreamingStick:   "TVStreamingStick",
+}
+
+func (c AccessoryCategory) String() string {
+	if name, ok := categoryNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", uint16(c))
+}
+
+// FeatureFlags are pairing features advertised with "ff" TXT key.
+type FeatureFlags uint8
+
+const (
+	// FeatureHardwareAuthentication indicates support of Apple authentication coprocessor.
+	FeatureHardwareAuthentication FeatureFlags = 0x01
+	// FeatureSoftwareAuthentication indicates support of software authentication.
+	FeatureSoftwareAuthentication FeatureFlags = 0x02
+)
+
+// StatusFlags are accessory status flags advertised with "sf" TXT key.
+type StatusFlags uint8
+
+const (
+	// StatusNotPaired is set when accessory has not been paired with any controllers.
+	StatusNotPaired StatusFlags = 0x01
+	// StatusNotConfiguredForWiFi is set when accessory has not been configured to join a Wi-Fi network.
+	StatusNotConfiguredForWiFi StatusFlags = 0x02
+	// StatusProblemDetected is set when accessory has detected a problem.
+	StatusProblemDetected StatusFlags = 0x04
+)
+
+// DeviceInfo is parsed TXT record of _hap._tcp service.
+type DeviceInfo struct {
+	ConfigNumber    uint32            // c#, incremented when accessory database changes
+	FeatureFlags    FeatureFlags      // ff
+	Id              string            // id, device id in form of XX:XX:XX:XX:XX:XX
+	Model           string            // md
+	ProtocolVersion string            // pv
+	StateNumber     uint32            // s#
+	StatusFlags     StatusFlags       // sf
+	Category        AccessoryCategory // ci
+	SetupHash       string            // sh, base64 encoded
+}
+
+// IsPaired returns true if accessory advertises that it has been paired with some controller.
+func (i DeviceInfo) IsPaired() bool {
+	return i.StatusFlags&StatusNotPaired == 0
+}
+
+// ParseDeviceInfo parses TXT record of _hap._tcp service.
+// Missing keys are left zero, error is returned for malformed numeric values.
+func ParseDeviceInfo(txt map[string]string) (DeviceInfo, error) {
+	var info DeviceInfo
+	var err error
+
+	parseUint := func(key string, bitSize int) uint64 {
+		v, ok := txt[key]
+		if !ok || v == "" {
+			return 0
+		}
+		n, e := strconv.ParseUint(v, 10, bitSize)
+		if e != nil && err == nil {
+			err = fmt.Errorf("invalid txt value %s=%s: %w", key, v, e)
+		}
+		return n
+	}
+
+	info.ConfigNumber = uint32(parseUint("c#", 32))
+	info.FeatureFlags = FeatureFlags(parseUint("ff", 8))
+	info.Id = txt["id"]
+	info.Model = txt["md"]
+	info.ProtocolVersion = txt["pv"]
+	info.StateNumber = uint32(parseUint("s#", 32))
+	info.StatusFlags = StatusFlags(parseUint("sf", 8))
+	info.Category = AccessoryCategory(parseUint("ci", 16))
+	info.SetupHash = txt["sh"]
+
+	return info, err
+}
+
+// MatchesSetupPayload reports whether scanned setup payload belongs to this device.
+// It compares setup hash ("sh") advertised by device with the one computed from payload setup id.
+func (d *Device) MatchesSetupPayload(p setuppayload.Payload) bool {
+	info := d.Info()
+	return p.Matches(info.SetupHash, info.Id)
+}
@@ -0,0 +1,81 @@
+package hkontroller
+
+import (
+	"testing"
+)
+
+func TestParseDeviceInfo(t *testing.T) {
+	tests := []struct {
+		txt   map[string]string
+		want  DeviceInfo
+		valid bool
+	}{
+		{
+			txt: map[string]string{
+				"c#": "42", "ff": "2", "id": "AA:BB:CC:DD:EE:FF", "md": "Lamp",
+				"pv": "1.1", "s#": "7", "sf": "1", "ci": "5", "sh": "Jyv0aQ==",
+			},
+			want: DeviceInfo{
+				ConfigNumber:    42,
+				FeatureFlags:    FeatureSoftwareAuthentication,
+				Id:              "AA:BB:CC:DD:EE:FF",
+				Model:           "Lamp",
+				ProtocolVersion: "1.1",
+				StateNumber:     7,
+				StatusFlags:     StatusNotPaired,
+				Category:        Category_Lightbulb,
+				SetupHash:       "Jyv0aQ==",
+			},
+			valid: true,
+		},
+		{
+			// missing keys are zero
+			txt:   map[string]string{"id": "AA:BB:CC:DD:EE:FF"},
+			want:  DeviceInfo{Id: "AA:BB:CC:DD:EE:FF"},
+			valid: true,
+		},
+		{
+			txt:   map[string]string{"c#": ""},
+			want:  DeviceInfo{},
+			valid: true,
+		},
+		{
+			txt:   map[string]string{"sf": "5", "ff": "3"},
+			want:  DeviceInfo{StatusFlags: StatusNotPaired | StatusProblemDetected, FeatureFlags: FeatureHardwareAuthentication | FeatureSoftwareAuthentication},
+			valid: true,
+		},
+		{txt: map[string]string{"c#": "abc"}},
+		{txt: map[string]string{"c#": "-1"}},
+		{txt: map[string]string{"s#": "4294967296"}},
+		{txt: map[string]string{"sf": "256"}},
+		{txt: map[string]string{"ff": "0x01"}},
+		{txt: map[string]string{"ci": "70000"}},
+		{
+			// other values are parsed despite malformed one
+			txt:  map[string]string{"c#": "x", "md": "Lamp", "s#": "3"},
+			want: DeviceInfo{Model: "Lamp", StateNumber: 3},
+		},
+	}
+
+	for i, test := range tests {
+		info, err := ParseDeviceInfo(test.txt)
+		if is, want := err == nil, test.valid; is != want {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if !test.valid && test.want == (DeviceInfo{}) {
+			continue
+		}
+		if is, want := info, test.want; is != want {
+			t.Fatalf("%d: is=%+v want=%+v", i, is, want)
+		}
+	}
+}
+
+func TestDeviceInfoIsPaired(t *testing.T) {
+	if is, want := (DeviceInfo{StatusFlags: StatusNotPaired}).IsPaired(), false; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := (DeviceInfo{StatusFlags: StatusProblemDetected}).IsPaired(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/hkontrol/hkontroller/log"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,16 +24,50 @@ const dialTimeout = 5 * time.Second
 const reqTimeout = 15 * time.Second
 const emitTimeout = 30 * time.Second
 
+var errConnectionClosed = errors.New("connection closed")
+
+// Device is HomeKit accessory discovered via mdns, loaded with LoadPairings
+// or added with AddStaticDevice.
+//
+// Device is safe for concurrent use. Its state is guarded by mu and exposed
+// through accessors returning copies. Connection lifecycle, that is connect,
+// pair-setup and pair-verify, is serialized by connMu, so concurrent
+// PairVerify calls don't race for single connection. Requests may be sent
+// from any goroutine, they are written one at a time by round tripper of
+// current connection.
+// Close may be called any time: connection is detached under mu and closed,
+// so pending requests fail. Background read loop of closed connection
+// exits without touching connection established after it.
+// Events are emitted with no locks held. Typed events of Controller.Events
+// never block. Emitter channels are buffered, characteristic events are
+// skipped for full channel, other topics wait for listener up to emitTimeout.
 type Device struct {
 	ee emitter.Emitter
 
-	Name string
+	connMu sync.Mutex // serializes connect, pair-setup and pair-verify
+
+	// mu guards all the fields below except immutable ones
+	mu            sync.Mutex
+	keepConnected bool // is KeepConnected loop running?
+
+	subscriptions map[subscription]struct{}         // restored after pair-verify
+	excluded      map[subscription]struct{}         // unsubscribed, but covered by wider subscription
+	listeners     map[string][]<-chan emitter.Event // event listeners by exact topic
+
+	Name string // immutable
+
+	logger *slog.Logger // immutable, with device name attribute
+	events *eventBus    // immutable, set before device is added to controller
+	mirror *stateMirror // immutable, set before device is added to controller
 
 	dnssdBrowseEntry *dnssd.BrowseEntry
+	info             DeviceInfo    // parsed from dnssd TXT record
+	staticAddress    string        // host:port to connect if not discovered
+	knownAddress     *KnownAddress // last address resolved via mdns, used if not discovered
 
-	controllerId   string
-	controllerLTPK []byte
-	controllerLTSK []byte
+	controllerId   string // immutable
+	controllerLTPK []byte // immutable
+	controllerLTSK []byte // immutable
 
 	pairing Pairing
 
@@ -45,15 +82,20 @@ type Device struct {
 	ss    *session
 	httpc *http.Client // http client with encryption support
 	accs  []*Accessory
+
+	// last fetched accessories, kept after connection is closed,
+	// so accessory database changed meanwhile is diffed on next fetch
+	fetched       []*Accessory
+	fetchedConfig uint32 // config number of fetched accessories
 }
 
 type roundTripper struct {
-	d  *Device
+	cc *conn
 	mu sync.Mutex
 }
 
-func newRoundTripper(d *Device) *roundTripper {
-	return &roundTripper{d: d, mu: sync.Mutex{}}
+func newRoundTripper(cc *conn) *roundTripper {
+	return &roundTripper{cc: cc, mu: sync.Mutex{}}
 }
 
 // RoundTrip implementation to be able to use with http.Client
@@ -62,111 +104,171 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	//fmt.Println("===== roundTrip =====")
-	//dump, err := httputil.DumpRequest(req, false)
-	//if err == nil {
-	//	fmt.Println(string(dump))
-	//}
-
-	// make response channel
-	r.d.cc.response = make(chan *http.Response)
-	defer close(r.d.cc.response)
-	r.d.cc.resError = make(chan error)
-	defer close(r.d.cc.resError)
-	r.d.cc.wantResponse = true
-	defer func() { r.d.cc.wantResponse = false }()
-
-	err := req.Write(r.d.cc)
-	if err != nil {
-		return nil, err
+	cc := r.cc
+	if cc.isClosed() {
+		return nil, errConnectionClosed
 	}
 
-	if r.d.cc.inBackground {
-		// select err or response
-		select {
-		case res := <-r.d.cc.response:
-			//fmt.Println("case <- d.cc.response")
-			return res, err
-		case err := <-r.d.cc.resError:
-			//fmt.Println("case <- d.cc.resError")
+	if !cc.inBackground.Load() {
+		// no background loop to select on, so request context
+		// is applied to connection as i/o deadline
+		stop := cc.watchContext(req.Context())
+		defer stop()
+
+		err := req.Write(cc)
+		if err != nil {
 			return nil, err
-		case <-req.Context().Done():
-			//fmt.Println("case <- req.Context().Done()")
-			return nil, req.Context().Err()
 		}
+
+		rd := bufio.NewReader(cc)
+		return http.ReadResponse(rd, req)
 	}
 
-	rd := bufio.NewReader(r.d.cc)
-	res, err := http.ReadResponse(rd, req)
+	wait := cc.expectResponse()
+	defer cc.cancelResponse()
+
+	err := req.Write(cc)
 	if err != nil {
 		return nil, err
 	}
 
-	return res, nil
+	// select err or response
+	select {
+	case r := <-wait:
+		return r.res, r.err
+	case <-cc.backgroundStop:
+		// loop may deliver response right before it exits
+		select {
+		case r := <-wait:
+			return r.res, r.err
+		default:
+		}
+		return nil, errConnectionClosed
+	case <-req.Context().Done():
+		// request is written, response to it still comes
+		cc.discardResponse()
+		return nil, req.Context().Err()
+	}
 }
 
 func newDevice(dnssdEntry *dnssd.BrowseEntry, name string,
-	controllerId string, controllerLTPK []byte, controllerLTSK []byte) *Device {
+	controllerId string, controllerLTPK []byte, controllerLTSK []byte, logger *slog.Logger) *Device {
 
 	d := &Device{
-		dnssdBrowseEntry: dnssdEntry,
-		Name:             name,
-		controllerId:     controllerId,
-		controllerLTPK:   controllerLTPK,
-		controllerLTSK:   controllerLTSK,
-		ee:               emitter.Emitter{},
+		Name:           name,
+		controllerId:   controllerId,
+		controllerLTPK: controllerLTPK,
+		controllerLTSK: controllerLTSK,
+		ee:             emitter.Emitter{Cap: eventBufferSize},
 	}
+	// characteristic events are read by connection loop,
+	// so slow listener must not stall it, see Controller.Events
+	d.ee.Use("event * *", emitter.Skip)
 
 	if dnssdEntry != nil {
 		d.Name = dnssdEntry.Name
 	}
+	d.logger = logger.With("device", d.Name)
+	if dnssdEntry != nil {
+		d.mergeDnssdEntry(*dnssdEntry)
+	}
 
 	return d
 }
 
-func (d *Device) setDnssdEntry(e *dnssd.BrowseEntry) {
-	d.dnssdBrowseEntry = e
-	if e != nil {
-		d.Name = e.Name
+// setDiscovered marks device as advertised via mdns or lost.
+// Entry of lost device is forgotten, known address is kept to reach device later.
+func (d *Device) setDiscovered(discovered bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.discovered = discovered
+	if !discovered {
+		d.dnssdBrowseEntry = nil
 	}
 }
 
 func (d *Device) mergeDnssdEntry(e dnssd.BrowseEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.dnssdBrowseEntry == nil {
+		e.IPs = append([]net.IP{}, e.IPs...)
 		d.dnssdBrowseEntry = &e
+		d.updateInfo(e.Text)
 		return
 	}
-	for _, ip := range e.IPs {
-		d.dnssdBrowseEntry.IPs = append(d.dnssdBrowseEntry.IPs, ip)
+	// latest resolved addresses replace previous ones,
+	// so addresses device doesn't use anymore are not dialed and saved
+	if len(e.IPs) > 0 {
+		d.dnssdBrowseEntry.IPs = append([]net.IP{}, e.IPs...)
+	}
+	if e.Port != 0 {
+		d.dnssdBrowseEntry.Port = e.Port
+	}
+	if e.Host != "" {
+		d.dnssdBrowseEntry.Host = e.Host
+	}
+	if e.IfaceName != "" {
+		d.dnssdBrowseEntry.IfaceName = e.IfaceName
+	}
+	if len(e.Text) > 0 {
+		d.dnssdBrowseEntry.Text = e.Text
+		d.updateInfo(e.Text)
+	}
+}
+
+// updateInfo parses TXT record, d.mu should be held.
+func (d *Device) updateInfo(txt map[string]string) {
+	info, err := ParseDeviceInfo(txt)
+	if err != nil {
+		d.logger.Debug("invalid txt record", "err", err)
 	}
+	d.info = info
+}
+
+// Info returns parsed TXT record of last discovered dnssd entry.
+func (d *Device) Info() DeviceInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.info
 }
 
 func (d *Device) GetDnssdEntry() dnssd.BrowseEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.dnssdBrowseEntry != nil {
-		return *d.dnssdBrowseEntry
+		e := *d.dnssdBrowseEntry
+		e.IPs = append([]net.IP{}, e.IPs...)
+		return e
 	}
 	return dnssd.BrowseEntry{}
 }
 
-func (d *Device) doRequest(req *http.Request) (*http.Response, error) {
-	if d.httpc == nil || d.cc.closed {
-		return nil, errors.New("no http client available")
+// httpClient returns http client of open connection or nil.
+func (d *Device) httpClient() *http.Client {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.httpc == nil || d.cc == nil || d.cc.isClosed() {
+		return nil
 	}
-	return d.httpc.Do(req)
+	return d.httpc
 }
-func (d *Device) doPost(url string, contentType string, body io.Reader) (*http.Response, error) {
-	if d.httpc == nil || d.cc.closed {
+
+func (d *Device) doRequest(req *http.Request) (*http.Response, error) {
+	httpc := d.httpClient()
+	if httpc == nil {
 		return nil, errors.New("no http client available")
 	}
-	return d.httpc.Post(url, contentType, body)
+	return httpc.Do(req)
 }
-func (d *Device) doGet(url string) (*http.Response, error) {
-	if d.httpc == nil || d.cc.closed {
-		return nil, errors.New("no http client available")
+func (d *Device) doPost(ctx context.Context, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err
 	}
-	return d.httpc.Get(url)
+	req.Header.Set("Content-Type", contentType)
+	return d.doRequest(req)
 }
-
 func (d *Device) emit(topic string, args ...interface{}) {
 	defer func() {
 		// sometimes done channel is closed before emitTimeout
@@ -183,6 +285,9 @@ func (d *Device) emit(topic string, args ...interface{}) {
 }
 
 func (d *Device) offAllTopics() {
+	d.mu.Lock()
+	d.listeners = nil
+	d.mu.Unlock()
 	for _, t := range d.ee.Topics() {
 		d.ee.Off(t)
 	}
@@ -191,7 +296,7 @@ func (d *Device) OnDiscovered() <-chan emitter.Event {
 	return d.ee.On("discover")
 }
 func (d *Device) OffDiscovered(ch <-chan emitter.Event) {
-	d.ee.Off("discovered", ch)
+	d.ee.Off("discover", ch)
 }
 func (d *Device) OnLost() <-chan emitter.Event {
 	return d.ee.On("lost")
@@ -217,6 +322,17 @@ func (d *Device) OnVerified() <-chan emitter.Event {
 func (d *Device) OffVerified(ch <-chan emitter.Event) {
 	d.ee.Off("verified", ch)
 }
+
+// OnAccessoriesChanged returns channel receiving AccessoriesDiff
+// when fetched accessory database differs from previously fetched one.
+// Accessories are refetched when config number changes,
+// after next pair-verify if device is not connected at that time.
+func (d *Device) OnAccessoriesChanged() <-chan emitter.Event {
+	return d.ee.On("accessories")
+}
+func (d *Device) OffAccessoriesChanged(ch <-chan emitter.Event) {
+	d.ee.Off("accessories", ch)
+}
 func (d *Device) OnUnpaired() <-chan emitter.Event {
 	return d.ee.On("unpaired")
 }
@@ -225,128 +341,293 @@ func (d *Device) OffUnpaired(ch <-chan emitter.Event) {
 }
 
 func (d *Device) close(reason error) error {
-	log.Debug.Println("device <%s> close call with reason: %v\n", d.Name, reason)
-	d.closeReason = reason
-	var err error
-	if d.cc != nil {
-		d.cc.close()
-		if d.verified {
-			for range d.cc.backgroundStop {
-			}
-		}
-		d.cc = nil
+	d.closeConn(nil, reason)
+	return nil
+}
+
+// closeConn closes connection cc if it is still current one,
+// or current connection if cc is nil.
+// Close of stale connection, e.g. by its background loop, is ignored.
+func (d *Device) closeConn(cc *conn, reason error) {
+	d.mu.Lock()
+	if cc != nil && d.cc != cc {
+		d.mu.Unlock()
+		return
 	}
-	d.verified = false
+	cur := d.cc
+	d.closeReason = reason
+	d.cc = nil
 	d.httpc = nil
-
+	d.verified = false
 	d.accs = nil
+	d.mu.Unlock()
 
-	d.ee.Off("event*") // close all subscriptions to char events
+	// subscriptions to char events are kept,
+	// so they can be restored on next pair-verify
 
+	if cur == nil {
+		return
+	}
+	d.logger.Debug("closing", "reason", reason)
+	cur.close()
+	d.events.publish(Closed{deviceEvent{d}, reason})
 	d.emit("close")
-	return err
 }
 
 func (d *Device) Close() error {
-	return d.close(errors.New("manual close "))
+	return d.close(errors.New("manual close"))
 }
 
-func (d *Device) connect() error {
-
-	if d.cc != nil {
-		d.close(errors.New("close on reconnect"))
+// ensureConnected connects device unless there is open connection.
+// d.connMu should be held.
+func (d *Device) ensureConnected(ctx context.Context) error {
+	d.mu.Lock()
+	cc := d.cc
+	d.mu.Unlock()
+	if cc != nil && !cc.isClosed() {
+		return nil
 	}
+	return d.connect(ctx)
+}
 
-	if d.dnssdBrowseEntry == nil || !d.discovered {
-		return errors.New("not discovered")
+// connect dials discovered, static or last known address
+// and replaces current connection. d.connMu should be held.
+func (d *Device) connect(ctx context.Context) error {
+	d.close(errors.New("close on reconnect"))
+
+	d.mu.Lock()
+	var entry *dnssd.BrowseEntry
+	if d.dnssdBrowseEntry != nil && d.discovered {
+		e := *d.dnssdBrowseEntry
+		e.IPs = append([]net.IP{}, e.IPs...)
+		entry = &e
+	}
+	var known *dnssd.BrowseEntry
+	if d.knownAddress != nil {
+		known = &dnssd.BrowseEntry{
+			IPs:       append([]net.IP{}, d.knownAddress.IPs...),
+			Port:      d.knownAddress.Port,
+			IfaceName: d.knownAddress.IfaceName,
+		}
 	}
+	staticAddress := d.staticAddress
+	d.mu.Unlock()
 
-	dial, err := dialServiceInstance(context.Background(), d.dnssdBrowseEntry, dialTimeout)
+	var dial net.Conn
+	var err error
+	if entry != nil {
+		dial, err = dialServiceInstance(ctx, entry, dialTimeout, d.logger)
+	} else {
+		err = errors.New("not discovered")
+	}
+	if err != nil && staticAddress != "" {
+		d.logger.Debug("dialing static address", "addr", staticAddress)
+		dialer := net.Dialer{Timeout: dialTimeout}
+		dial, err = dialer.DialContext(ctx, "tcp", staticAddress)
+	}
+	if err != nil && known != nil {
+		d.logger.Debug("dialing last known address")
+		dial, err = dialServiceInstance(ctx, known, dialTimeout, d.logger)
+	}
 	if err != nil {
 		return err
 	}
 
 	// connection, http client
-	cc := newConn(dial)
+	cc := newConn(dial, d.logger)
+	cc.SetEventCallback(d.onEvent)
+
+	d.mu.Lock()
 	d.cc = cc
 	d.httpc = &http.Client{
-		Transport: newRoundTripper(d),
+		Transport: newRoundTripper(cc),
 	}
-	d.cc.SetEventCallback(d.onEvent)
-
 	d.closeReason = nil
+	d.mu.Unlock()
 
 	return nil
 }
 
-func (d *Device) startBackgroundRead() {
+// startBackgroundRead starts reading responses and events of cc.
+// Device is closed when reading stops, unless cc is replaced already.
+func (d *Device) startBackgroundRead(cc *conn) {
+	cc.inBackground.Store(true)
 	go func() {
-		d.cc.loop()
-		log.Debug.Println("background read: loop stopped")
-		d.close(errors.New("stop background read"))
+		cc.loop()
+		d.logger.Debug("background read stopped")
+		d.closeConn(cc, errors.New("stop background read"))
 	}()
 }
 
+// KnownAddress returns last address of device resolved via mdns.
+// It is restored by LoadPairings for paired devices,
+// so they can be reached before discovered again.
+func (d *Device) KnownAddress() (KnownAddress, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.knownAddress == nil {
+		return KnownAddress{}, false
+	}
+	a := *d.knownAddress
+	a.IPs = append([]net.IP{}, a.IPs...)
+	return a, true
+}
+
+// updateKnownAddress sets known address from discovered dnssd entry.
+// It returns true if address changed.
+func (d *Device) updateKnownAddress() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.dnssdBrowseEntry
+	if e == nil || len(e.IPs) == 0 || e.Port == 0 {
+		return false
+	}
+	a := KnownAddress{
+		IPs:       append([]net.IP{}, e.IPs...),
+		Port:      e.Port,
+		IfaceName: e.IfaceName,
+	}
+	if d.knownAddress != nil && d.knownAddress.equal(a) {
+		return false
+	}
+	d.knownAddress = &a
+	return true
+}
+
+// loadPairing restores stored pairing and addresses.
+func (d *Device) loadPairing(p Pairing, known *KnownAddress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pairing = p
+	d.paired = true
+	d.staticAddress = p.Address
+	if known != nil {
+		d.knownAddress = known
+	}
+}
+
+// setStaticAddress sets address to connect if not discovered.
+// It returns updated pairing and true if device is paired.
+func (d *Device) setStaticAddress(address string) (Pairing, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.staticAddress = address
+	if !d.paired {
+		return Pairing{}, false
+	}
+	d.pairing.Address = address
+	return d.pairing, true
+}
+
+// forgetPairing resets pairing state after device is unpaired.
+func (d *Device) forgetPairing() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pairing = Pairing{}
+	d.paired = false
+	d.knownAddress = nil
+	d.ss = nil
+	d.fetched = nil
+}
+
+// isReachable returns true if there is address to connect device.
+func (d *Device) isReachable() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.discovered || d.knownAddress != nil || d.staticAddress != ""
+}
+
+// StaticAddress returns host:port used to connect when device is not discovered.
+func (d *Device) StaticAddress() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.staticAddress
+}
+
 // IsDiscovered indicates if device is advertised via multicast dns
 func (d *Device) IsDiscovered() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.discovered
 }
 
 // IsPaired returns true if device is paired by this controller.
 // If another client is paired with device it will return false.
 func (d *Device) IsPaired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.paired
 }
 
 func (d *Device) GetPairingInfo() Pairing {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.pairing
 }
 
 // IsVerified returns true if /pair-verify step was completed by this controller.
 func (d *Device) IsVerified() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.verified
 }
 
 // CloseReason returns last close reason if connection is closed
 func (d *Device) CloseReason() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.closeReason
 }
 
 // Accessories return list of previously discovered accessories.
 // GetAccessories should be called prior to this call.
+// Returned list is a copy, values of characteristics are updated by events
+// in device only, so call it again to see them.
 func (d *Device) Accessories() []*Accessory {
-	return d.accs
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copyAccessories(d.accs)
 }
 
 // GetAccessories sends GET /accessories request and store
 // result that can be retrieved with Accessories() method.
 func (d *Device) GetAccessories() error {
-
-	if !d.verified || d.httpc == nil {
-		return errors.New("paired device not verified or not connected")
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
 	defer cancel()
+	return d.GetAccessoriesContext(ctx)
+}
+
+// GetAccessoriesContext is like GetAccessories but uses ctx for the request.
+func (d *Device) GetAccessoriesContext(ctx context.Context) error {
+	_, err := d.fetchAccessories(ctx)
+	return err
+}
+
+// fetchAccessories requests /accessories and returns difference with previously fetched ones.
+// Accessories changed event is emitted unless difference is empty or nothing was fetched before.
+func (d *Device) fetchAccessories(ctx context.Context) (AccessoriesDiff, error) {
+	if !d.IsVerified() {
+		return AccessoriesDiff{}, errors.New("paired device not verified or not connected")
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", "/accessories", nil)
 	if err != nil {
-		return err
+		return AccessoriesDiff{}, err
 	}
 	res, err := d.doRequest(req)
 	if err != nil {
-		return nil
+		return AccessoriesDiff{}, err
 	}
 
 	all, err := io.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return AccessoriesDiff{}, err
 	}
 
 	var accs Accessories
 	err = json.Unmarshal(all, &accs)
 	if err != nil {
-		return err
+		return AccessoriesDiff{}, err
 	}
 
 	// shorten UUIDs
@@ -359,17 +640,35 @@ func (d *Device) GetAccessories() error {
 		}
 	}
 
+	d.mu.Lock()
+	prev := d.fetched
 	d.accs = accs.Accs
+	d.fetched = accs.Accs
+	d.fetchedConfig = d.info.ConfigNumber
+	d.mu.Unlock()
+	d.mirror.setAccessories(d.Name, accs.Accs)
 
-	return nil
+	if prev == nil {
+		// never fetched before, nothing to compare with
+		return AccessoriesDiff{}, nil
+	}
+	diff := DiffAccessories(prev, accs.Accs)
+	if !diff.IsEmpty() {
+		d.emit("accessories", diff)
+	}
+	return diff, nil
 }
 
 // GetCharacteristic sends GET /characteristic request and return characteristic description and value.
 func (d *Device) GetCharacteristic(aid uint64, cid uint64) (CharacteristicDescription, error) {
-	ep := fmt.Sprintf("/characteristics?id=%d.%d", aid, cid)
-
 	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
 	defer cancel()
+	return d.GetCharacteristicContext(ctx, aid, cid)
+}
+
+// GetCharacteristicContext is like GetCharacteristic but uses ctx for the request.
+func (d *Device) GetCharacteristicContext(ctx context.Context, aid uint64, cid uint64) (CharacteristicDescription, error) {
+	ep := fmt.Sprintf("/characteristics?id=%d.%d", aid, cid)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", ep, nil)
 
@@ -398,7 +697,8 @@ func (d *Device) GetCharacteristic(aid uint64, cid uint64) (CharacteristicDescri
 	}
 
 	for _, c := range chrs.Characteristics {
-		if c.Aid == aid || c.Iid == cid {
+		if c.Aid == aid && c.Iid == cid {
+			d.mirror.setValue(d.Name, c.Aid, c.Iid, c.Value)
 			return c, nil
 		}
 	}
@@ -406,44 +706,319 @@ func (d *Device) GetCharacteristic(aid uint64, cid uint64) (CharacteristicDescri
 	return CharacteristicDescription{}, errors.New("wrong response")
 }
 
-// PutCharacteristic makes PUT /characteristic request to control characteristic value.
-func (d *Device) PutCharacteristic(aid uint64, cid uint64, val interface{}) error {
+// GetCharacteristics sends single GET /characteristics request for all ids.
+// Result contains one description per id in the same order.
+// Status field is set for every result, JsonStatusSuccess on success.
+func (d *Device) GetCharacteristics(ids []CharacteristicID, opts ReadOptions) ([]CharacteristicDescription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.GetCharacteristicsContext(ctx, ids, opts)
+}
 
-	type putPayload struct {
-		Cs []CharacteristicPut `json:"characteristics"`
+// GetCharacteristicsContext is like GetCharacteristics but uses ctx for the request.
+func (d *Device) GetCharacteristicsContext(ctx context.Context, ids []CharacteristicID, opts ReadOptions) ([]CharacteristicDescription, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("no characteristics to read")
 	}
 
-	c := putPayload{Cs: []CharacteristicPut{{Aid: aid, Iid: cid, Value: val}}}
-	b, err := json.Marshal(c)
+	idStrs := make([]string, len(ids))
+	for i, id := range ids {
+		idStrs[i] = fmt.Sprintf("%d.%d", id.Aid, id.Iid)
+	}
+	query := url.Values{}
+	query.Set("id", strings.Join(idStrs, ","))
+	if opts.Meta {
+		query.Set("meta", "1")
+	}
+	if opts.Perms {
+		query.Set("perms", "1")
+	}
+	if opts.Type {
+		query.Set("type", "1")
+	}
+	if opts.Events {
+		query.Set("ev", "1")
+	}
+	// ids are joined with comma which should not be escaped
+	ep := "/characteristics?" + strings.ReplaceAll(query.Encode(), "%2C", ",")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ep, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := d.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("invalid status code %v", res.StatusCode)
+	}
+
+	all, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	type responsePayload struct {
+		Characteristics []CharacteristicDescription `json:"characteristics"`
+	}
+
+	var chrs responsePayload
+	err = json.Unmarshal(all, &chrs)
+	if err != nil {
+		return nil, err
+	}
+
+	received := make(map[CharacteristicID]CharacteristicDescription)
+	for _, c := range chrs.Characteristics {
+		if c.Status == nil {
+			status := JsonStatusSuccess
+			c.Status = &status
+		}
+		if c.Type != "" {
+			c.Type = c.Type.ToShort()
+		}
+		if *c.Status == JsonStatusSuccess {
+			d.mirror.setValue(d.Name, c.Aid, c.Iid, c.Value)
+		}
+		received[CharacteristicID{c.Aid, c.Iid}] = c
+	}
+
+	result := make([]CharacteristicDescription, len(ids))
+	for i, id := range ids {
+		c, ok := received[id]
+		if !ok {
+			// accessory did not report this characteristic
+			status := JsonStatusResourceDoesNotExist
+			c = CharacteristicDescription{Aid: id.Aid, Iid: id.Iid, Status: &status}
+		}
+		result[i] = c
+	}
+
+	return result, nil
+}
+
+// PutCharacteristic makes PUT /characteristic request to control characteristic value.
+func (d *Device) PutCharacteristic(aid uint64, cid uint64, val interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.PutCharacteristicContext(ctx, aid, cid, val)
+}
+
+// PutCharacteristicContext is like PutCharacteristic but uses ctx for the request.
+func (d *Device) PutCharacteristicContext(ctx context.Context, aid uint64, cid uint64, val interface{}) error {
+	results, err := d.PutCharacteristicsContext(ctx, []CharacteristicPut{{Aid: aid, Iid: cid, Value: val}})
 	if err != nil {
 		return err
 	}
+	return results[0].Err
+}
 
+// PutCharacteristics writes all values with single PUT /characteristics request.
+// Result contains one entry per written characteristic in the same order.
+// Returned error is not nil only if request itself failed,
+// per-characteristic failures are reported in CharacteristicResult.Err.
+func (d *Device) PutCharacteristics(cs []CharacteristicPut) ([]CharacteristicResult, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
 	defer cancel()
+	return d.PutCharacteristicsContext(ctx, cs)
+}
+
+// PutCharacteristicsContext is like PutCharacteristics but uses ctx for the request.
+func (d *Device) PutCharacteristicsContext(ctx context.Context, cs []CharacteristicPut) ([]CharacteristicResult, error) {
+	return d.putCharacteristics(ctx, cs, nil)
+}
+
+// putCharacteristics sends PUT /characteristics request.
+// pid is set for timed write, see TimedWrite.
+func (d *Device) putCharacteristics(ctx context.Context, cs []CharacteristicPut, pid *uint64) ([]CharacteristicResult, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("no characteristics to write")
+	}
+
+	cs, err := d.validateWrites(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	type putPayload struct {
+		Cs  []CharacteristicPut `json:"characteristics"`
+		Pid *uint64             `json:"pid,omitempty"`
+	}
+
+	b, err := json.Marshal(putPayload{Cs: cs, Pid: pid})
+	if err != nil {
+		return nil, err
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	res, err := d.doRequest(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_ = res
 
-	//all, err := io.ReadAll(res.Body)
-	//if err != nil {
-	//	return err
-	//}
-	//
-	// TODO: extract errors. if response message is empty then no error occured
-	// 		 case of error:
-	//        {"characteristics":[{"aid":1,"iid":12,"status":-70402}]}
-	// fmt.Println(string(all))
+	results := make([]CharacteristicResult, len(cs))
+	for i, c := range cs {
+		results[i] = CharacteristicResult{Aid: c.Aid, Iid: c.Iid, Status: JsonStatusSuccess}
+	}
 
-	return nil
+	if res.StatusCode == http.StatusNoContent {
+		// all values are written
+		d.mirrorWrites(cs, results)
+		return results, nil
+	}
+
+	all, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 207 Multi-Status or error code, body contains status for every characteristic
+	type responsePayload struct {
+		Characteristics []CharacteristicPut `json:"characteristics"`
+	}
+
+	var chrs responsePayload
+	err = json.Unmarshal(all, &chrs)
+	if err != nil || len(chrs.Characteristics) == 0 {
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusMultiStatus {
+			return nil, fmt.Errorf("invalid status code %v", res.StatusCode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.mirrorWrites(cs, results)
+		return results, nil
+	}
+
+	received := make(map[CharacteristicID]CharacteristicPut)
+	for _, c := range chrs.Characteristics {
+		received[CharacteristicID{c.Aid, c.Iid}] = c
+	}
+	for i := range results {
+		c, ok := received[CharacteristicID{results[i].Aid, results[i].Iid}]
+		if !ok {
+			continue
+		}
+		results[i].Value = c.Value
+		if c.Status == nil {
+			continue
+		}
+		results[i].Status = *c.Status
+		results[i].Err = JsonStatusErrorFromCode(*c.Status)
+		if results[i].Err != nil {
+			d.logger.Debug("writing characteristic failed",
+				"aid", results[i].Aid, "iid", results[i].Iid, "status", *c.Status)
+		}
+	}
+	d.mirrorWrites(cs, results)
+
+	return results, nil
+}
+
+// mirrorWrites records successfully written values in state mirror.
+func (d *Device) mirrorWrites(cs []CharacteristicPut, results []CharacteristicResult) {
+	for i, c := range cs {
+		if results[i].Err == nil {
+			d.mirror.setValue(d.Name, c.Aid, c.Iid, c.Value)
+		}
+	}
+}
+
+// validateWrites checks values against characteristics of fetched accessories.
+// It returns copy of cs with values converted to accessory representation.
+// Characteristics not known yet are written as is.
+func (d *Device) validateWrites(cs []CharacteristicPut) ([]CharacteristicPut, error) {
+	validated := make([]CharacteristicPut, len(cs))
+	copy(validated, cs)
+	for i, c := range validated {
+		if c.Value == nil {
+			continue
+		}
+		desc, ok := d.findCharacteristic(c.Aid, c.Iid)
+		if !ok {
+			continue
+		}
+		v, err := desc.validate(c.Aid, c.Value)
+		if err != nil {
+			return nil, err
+		}
+		validated[i].Value = v
+	}
+	return validated, nil
+}
+
+// findCharacteristic returns copy of characteristic of fetched accessories.
+func (d *Device) findCharacteristic(aid uint64, iid uint64) (CharacteristicDescription, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.accs {
+		if a.Id != aid {
+			continue
+		}
+		for _, s := range a.Ss {
+			for _, c := range s.Cs {
+				if c.Iid == iid {
+					return *c, true
+				}
+			}
+		}
+	}
+	return CharacteristicDescription{}, false
+}
+
+// WriteWithResponse writes value with write-response flag set
+// and returns value sent back by accessory.
+// It is used for control point characteristics, e.g. CType_SetupEndpoints.
+func (d *Device) WriteWithResponse(aid uint64, iid uint64, val interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.WriteWithResponseContext(ctx, aid, iid, val)
+}
+
+// WriteWithResponseContext is like WriteWithResponse but uses ctx for the request.
+func (d *Device) WriteWithResponseContext(ctx context.Context, aid uint64, iid uint64, val interface{}) (interface{}, error) {
+	r := true
+	results, err := d.PutCharacteristicsContext(ctx, []CharacteristicPut{{Aid: aid, Iid: iid, Value: val, Response: &r}})
+	if err != nil {
+		return nil, err
+	}
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	return results[0].Value, nil
+}
+
+// refetchAccessories is called when accessory database has changed.
+// It requests /accessories, emits diff and sends event subscriptions again,
+// so wildcard subscriptions cover new characteristics.
+func (d *Device) refetchAccessories() {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	diff, err := d.fetchAccessories(ctx)
+	if err != nil {
+		d.logger.Warn("refetching accessories failed", "err", err)
+		return
+	}
+	if diff.IsEmpty() {
+		return
+	}
+	if err := d.restoreSubscriptions(ctx); err != nil {
+		d.logger.Warn("restoring event subscriptions failed", "err", err)
+	}
+}
+
+// configChanged reports whether accessory database changed since accessories were fetched,
+// e.g. while device was not connected.
+func (d *Device) configChanged() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fetched != nil && d.info.ConfigNumber != 0 && d.info.ConfigNumber != d.fetchedConfig
 }
 
 func (d *Device) onEvent(res *http.Response) {
@@ -467,7 +1042,8 @@ func (d *Device) onEvent(res *http.Response) {
 		val := ch.Value
 
 		// update values, so it will be available without extra GetAccessories request
-		for _, aa := range d.Accessories() {
+		d.mu.Lock()
+		for _, aa := range d.accs {
 			if aa.Id != aid {
 				continue
 			}
@@ -479,8 +1055,13 @@ func (d *Device) onEvent(res *http.Response) {
 				}
 			}
 		}
+		d.mu.Unlock()
+
+		d.logger.Debug("characteristic changed", "aid", aid, "iid", iid, "value", val)
+		d.mirror.setValue(d.Name, aid, iid, val)
 
 		topic := fmt.Sprintf("event %d %d", aid, iid)
+		d.events.publish(CharacteristicChanged{deviceEvent{d}, aid, iid, val})
 		d.emit(topic, aid, iid, val)
 	}
 }
@@ -505,16 +1086,26 @@ func (d *Device) getEventPutPayloadForAccessory(aid int, subscribe bool) []Chara
 	return cs
 }
 
+// SubscribeToEvents enables notifications for characteristic value changes.
+// Subscription is remembered and sent again after next pair-verify,
+// so returned channel keeps receiving events across reconnects.
 func (d *Device) SubscribeToEvents(aid uint64, iid uint64) (<-chan emitter.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.SubscribeToEventsContext(ctx, aid, iid)
+}
+
+// SubscribeToEventsContext is like SubscribeToEvents but uses ctx for the request.
+func (d *Device) SubscribeToEventsContext(ctx context.Context, aid uint64, iid uint64) (<-chan emitter.Event, error) {
 	topic := fmt.Sprintf("event %d %d", aid, iid)
 	super := fmt.Sprintf("event %d *", aid)
 	mega := fmt.Sprintf("event * *")
 
-	for _, tt := range d.ee.Topics() {
-		if tt == topic || tt == super || tt == mega {
+	for _, tt := range d.eventTopics() {
+		if (tt == topic || tt == super || tt == mega) && !d.isExcluded(aid, iid) {
 			// already subscribed
 			// support multiple listeners
-			return d.ee.On(topic), nil
+			return d.onTopic(topic), nil
 		}
 	}
 
@@ -529,7 +1120,7 @@ func (d *Device) SubscribeToEvents(aid uint64, iid uint64) (<-chan emitter.Event
 		return nil, err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -543,19 +1134,30 @@ func (d *Device) SubscribeToEvents(aid uint64, iid uint64) (<-chan emitter.Event
 		return nil, errors.New("not 204")
 	}
 
-	return d.ee.On(topic), nil
+	d.addSubscription(aid, iid)
+
+	return d.onTopic(topic), nil
 }
 
+// SubscribeToAccessoryEvents enables notifications for all characteristics of accessory.
+// Subscription is restored after reconnect, see SubscribeToEvents.
 func (d *Device) SubscribeToAccessoryEvents(aid uint64) (<-chan emitter.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.SubscribeToAccessoryEventsContext(ctx, aid)
+}
+
+// SubscribeToAccessoryEventsContext is like SubscribeToAccessoryEvents but uses ctx for the request.
+func (d *Device) SubscribeToAccessoryEventsContext(ctx context.Context, aid uint64) (<-chan emitter.Event, error) {
 
 	topic := fmt.Sprintf("event %d *", aid)
 	super := fmt.Sprintf("event * *")
 
-	for _, tt := range d.ee.Topics() {
-		if tt == topic || tt == super {
+	for _, tt := range d.eventTopics() {
+		if (tt == topic || tt == super) && !d.isExcluded(aid, 0) {
 			// already subscribed
 			// support multiple listeners
-			return d.ee.On(topic), nil
+			return d.onTopic(topic), nil
 		}
 	}
 
@@ -569,7 +1171,7 @@ func (d *Device) SubscribeToAccessoryEvents(aid uint64) (<-chan emitter.Event, e
 		return nil, err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -583,18 +1185,29 @@ func (d *Device) SubscribeToAccessoryEvents(aid uint64) (<-chan emitter.Event, e
 		return nil, errors.New("not 204")
 	}
 
-	return d.ee.On(topic), nil
+	d.addSubscription(aid, 0)
+
+	return d.onTopic(topic), nil
 }
 
+// SubscribeToAllEvents enables notifications for all characteristics of device.
+// Subscription is restored after reconnect, see SubscribeToEvents.
 func (d *Device) SubscribeToAllEvents() (<-chan emitter.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.SubscribeToAllEventsContext(ctx)
+}
+
+// SubscribeToAllEventsContext is like SubscribeToAllEvents but uses ctx for the request.
+func (d *Device) SubscribeToAllEventsContext(ctx context.Context) (<-chan emitter.Event, error) {
 
 	topic := fmt.Sprintf("event * *")
 
-	for _, tt := range d.ee.Topics() {
+	for _, tt := range d.eventTopics() {
 		if tt == topic {
 			// already subscribed
 			// support multiple listeners
-			return d.ee.On(topic), nil
+			return d.onTopic(topic), nil
 		}
 	}
 
@@ -609,7 +1222,7 @@ func (d *Device) SubscribeToAllEvents() (<-chan emitter.Event, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -623,16 +1236,25 @@ func (d *Device) SubscribeToAllEvents() (<-chan emitter.Event, error) {
 		return nil, errors.New("not 204")
 	}
 
-	return d.ee.On(topic), nil
+	d.addSubscription(0, 0)
+
+	return d.onTopic(topic), nil
 }
 
 func (d *Device) UnsubscribeFromAllEvents(channels ...<-chan emitter.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.UnsubscribeFromAllEventsContext(ctx, channels...)
+}
+
+// UnsubscribeFromAllEventsContext is like UnsubscribeFromAllEvents but uses ctx for the request.
+func (d *Device) UnsubscribeFromAllEventsContext(ctx context.Context, channels ...<-chan emitter.Event) error {
 
 	topic := fmt.Sprintf("event * *")
 
-	if len(channels) != 0 && len(channels) < len(d.ee.Listeners(topic)) {
+	if len(channels) != 0 && len(channels) < len(d.topicListeners(topic)) {
 		// somebody else subscribed
-		d.ee.Off(topic, channels...)
+		d.offTopic(topic, channels...)
 		return nil
 	}
 
@@ -647,7 +1269,7 @@ func (d *Device) UnsubscribeFromAllEvents(channels ...<-chan emitter.Event) erro
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -657,22 +1279,30 @@ func (d *Device) UnsubscribeFromAllEvents(channels ...<-chan emitter.Event) erro
 		return err
 	}
 
+	d.removeSubscription(0, 0)
+
 	// close all related channels
-	for _, pp := range pl.Cs {
-		topic := fmt.Sprintf("event %d %d", pp.Aid, pp.Iid)
-		d.ee.Off(topic)
+	for _, topic := range d.eventTopics() {
+		d.offTopic(topic)
 	}
 
 	return nil
 }
 
 func (d *Device) UnsubscribeFromAccessoryEvents(aid uint64, channels ...<-chan emitter.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.UnsubscribeFromAccessoryEventsContext(ctx, aid, channels...)
+}
+
+// UnsubscribeFromAccessoryEventsContext is like UnsubscribeFromAccessoryEvents but uses ctx for the request.
+func (d *Device) UnsubscribeFromAccessoryEventsContext(ctx context.Context, aid uint64, channels ...<-chan emitter.Event) error {
 
 	topic := fmt.Sprintf("event %d *", aid)
 
-	if len(channels) != 0 && len(channels) < len(d.ee.Listeners(topic)) {
+	if len(channels) != 0 && len(channels) < len(d.topicListeners(topic)) {
 		// somebody else subscribed
-		d.ee.Off(topic, channels...)
+		d.offTopic(topic, channels...)
 		return nil
 	}
 
@@ -680,14 +1310,14 @@ func (d *Device) UnsubscribeFromAccessoryEvents(aid uint64, channels ...<-chan e
 		Cs []CharacteristicPut `json:"characteristics"`
 	}
 
-	pl := putPayload{Cs: d.getEventPutPayloadForAccessory(-1, false)}
+	pl := putPayload{Cs: d.getEventPutPayloadForAccessory(int(aid), false)}
 
 	b, err := json.Marshal(pl)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -697,22 +1327,31 @@ func (d *Device) UnsubscribeFromAccessoryEvents(aid uint64, channels ...<-chan e
 		return err
 	}
 
+	d.removeSubscription(aid, 0)
+
 	// close all related channels
 	for _, pp := range pl.Cs {
-		topic := fmt.Sprintf("event %d %d", pp.Aid, pp.Iid)
-		d.ee.Off(topic)
+		d.offTopic(fmt.Sprintf("event %d %d", pp.Aid, pp.Iid))
 	}
+	d.offTopic(topic)
 
 	return nil
 }
 
 func (d *Device) UnsubscribeFromEvents(aid uint64, iid uint64, channels ...<-chan emitter.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.UnsubscribeFromEventsContext(ctx, aid, iid, channels...)
+}
+
+// UnsubscribeFromEventsContext is like UnsubscribeFromEvents but uses ctx for the request.
+func (d *Device) UnsubscribeFromEventsContext(ctx context.Context, aid uint64, iid uint64, channels ...<-chan emitter.Event) error {
 
 	topic := fmt.Sprintf("event %d %d", aid, iid)
 
-	if len(channels) != 0 && len(channels) < len(d.ee.Listeners(topic)) {
+	if len(channels) != 0 && len(channels) < len(d.topicListeners(topic)) {
 		// somebody else subscribed
-		d.ee.Off(topic, channels...)
+		d.offTopic(topic, channels...)
 		return nil
 	}
 
@@ -727,7 +1366,7 @@ func (d *Device) UnsubscribeFromEvents(aid uint64, iid uint64, channels ...<-cha
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", "/characteristics", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -737,7 +1376,8 @@ func (d *Device) UnsubscribeFromEvents(aid uint64, iid uint64, channels ...<-cha
 		return err
 	}
 
-	d.ee.Off(topic)
+	d.removeSubscription(aid, iid)
+	d.offTopic(topic)
 
 	return nil
 }
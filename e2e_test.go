@@ -0,0 +1,1282 @@
+package hkontroller_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hkontrol/hkontroller"
+	"github.com/hkontrol/hkontroller/hktest"
+)
+
+const testSetupCode = "031-45-154"
+const testControllerId = "hktest-controller"
+
+func newTestServer(t *testing.T) *hktest.Server {
+	t.Helper()
+	srv, err := hktest.NewServer("Lamp", testSetupCode, []*hkontroller.Accessory{
+		hktest.NewLightbulb(1, "Lamp"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	return srv
+}
+
+func newTestDevice(t *testing.T, srv *hktest.Server) *hkontroller.Device {
+	t.Helper()
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+func pairAndVerify(t *testing.T, d *hkontroller.Device) {
+	t.Helper()
+	if err := d.PairSetup(testSetupCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairSetupAndVerify(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+
+	if err := d.PairSetup(testSetupCode); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d.IsPaired(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := d.GetPairingInfo().Id, srv.Id(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	pairings := srv.Pairings()
+	if is, want := len(pairings), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := pairings[0].Id, testControllerId; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := pairings[0].Permission, hkontroller.PermissionAdmin; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d.IsVerified(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(d.Accessories()), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if d.Accessories()[0].GetService(hkontroller.SType_LightBulb) == nil {
+		t.Fatal("no lightbulb service")
+	}
+}
+
+func TestPairSetupWrongCode(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+
+	err := d.PairSetup("111-22-333")
+	if !errors.Is(err, &hkontroller.TlvErrorAuthentication) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var setupErr *hkontroller.PairSetupError
+	if !errors.As(err, &setupErr) {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	if srv.IsPaired() {
+		t.Fatal("server should not be paired")
+	}
+}
+
+func TestPairSetupWithRetry(t *testing.T) {
+	policy := hkontroller.PairSetupRetryPolicy{BusyDelay: 10 * time.Millisecond}
+
+	t.Run("busy", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.FailPairSetup(hkontroller.TlvErrorBusy.Code, 0, 2)
+		d := newTestDevice(t, srv)
+
+		if err := d.PairSetupWithRetry(context.Background(), testSetupCode, policy); err != nil {
+			t.Fatal(err)
+		}
+		if is, want := srv.PairSetupAttempts(), 3; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if !srv.IsPaired() {
+			t.Fatal("server should be paired")
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.FailPairSetup(hkontroller.TlvErrorBackoff.Code, 1, 1)
+		d := newTestDevice(t, srv)
+
+		start := time.Now()
+		if err := d.PairSetupWithRetry(context.Background(), testSetupCode, policy); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Fatalf("retry delay not respected, retried after %v", elapsed)
+		}
+		if is, want := srv.PairSetupAttempts(), 2; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.FailPairSetup(hkontroller.TlvErrorBackoff.Code, 1, 5)
+		d := newTestDevice(t, srv)
+
+		err := d.PairSetupWithRetry(context.Background(), testSetupCode, hkontroller.PairSetupRetryPolicy{
+			MaxAttempts: 1,
+		})
+		var retryErr *hkontroller.RetryDelayError
+		if !errors.As(err, &retryErr) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if is, want := retryErr.RetryDelay, time.Second; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if !errors.Is(err, &hkontroller.TlvErrorBackoff) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if is, want := srv.PairSetupAttempts(), 1; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	})
+
+	t.Run("max tries", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.FailPairSetup(hkontroller.TlvErrorMaxTries.Code, 0, 5)
+		d := newTestDevice(t, srv)
+
+		err := d.PairSetupWithRetry(context.Background(), testSetupCode, policy)
+		if !errors.Is(err, &hkontroller.TlvErrorMaxTries) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if is, want := srv.PairSetupAttempts(), 1; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if srv.IsPaired() {
+			t.Fatal("server should not be paired")
+		}
+	})
+}
+
+func TestTransientPairSetup(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+
+	_, err := d.PairSetupWithOptions(context.Background(), testSetupCode, hkontroller.PairSetupOptions{
+		Method: hkontroller.MethodPair,
+		Flags:  hkontroller.PairingFlagTransient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d.IsVerified(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := d.IsPaired(), false; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if srv.IsPaired() {
+		t.Fatal("server should not be paired")
+	}
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFiPairSetup(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetMFiCertificate([]byte("certificate"))
+	d := newTestDevice(t, srv)
+
+	result, err := d.PairSetupWithOptions(context.Background(), testSetupCode, hkontroller.PairSetupOptions{
+		Method: hkontroller.MethodPairMFi,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := string(result.M4Certificate), "certificate"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if len(result.M4Signature) == 0 || len(result.M6Signature) == 0 {
+		t.Fatal("no signatures")
+	}
+	if is, want := result.AccessoryId, srv.Id(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestPairResume(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	d.Close()
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := srv.ResumedSessions(), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+
+	// resumed session may be resumed again
+	d.Close()
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := srv.ResumedSessions(), 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	// unknown session falls back to pair-verify
+	d.Close()
+	srv.ForgetSessions()
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := srv.ResumedSessions(), 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWriteCharacteristics(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	if err := d.PutCharacteristic(1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+	v, err := srv.Value(1, hktest.IidOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := v, true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	c, err := d.GetCharacteristic(1, hktest.IidOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := c.Value, true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	cs, err := d.GetCharacteristics([]hkontroller.CharacteristicID{
+		{Aid: 1, Iid: hktest.IidBrightness},
+		{Aid: 1, Iid: 99},
+	}, hkontroller.ReadOptions{Meta: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := *cs[0].Status, hkontroller.JsonStatusSuccess; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := *cs[0].Format, "int"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := *cs[1].Status, hkontroller.JsonStatusResourceDoesNotExist; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	err = d.PutCharacteristic(1, hktest.IidName, "Other")
+	if !errors.Is(err, &hkontroller.JsonErrorReadOnlyCharacteristic) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	srv.OnWrite(func(aid uint64, iid uint64, value interface{}) int {
+		return hkontroller.JsonStatusResourceBusy
+	})
+	err = d.PutCharacteristic(1, hktest.IidOn, false)
+	if !errors.Is(err, &hkontroller.JsonErrorResourceBusy) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCanceledRequest(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	release := make(chan struct{})
+	srv.OnWrite(func(aid uint64, iid uint64, value interface{}) int {
+		<-release
+		return hkontroller.JsonStatusSuccess
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := d.PutCharacteristicContext(ctx, 1, hktest.IidOn, true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// late response to canceled write must not be taken as response to read
+	close(release)
+	c, err := d.GetCharacteristic(1, hktest.IidName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := c.Value, "Lamp"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := d.IsVerified(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestInvalidWrite(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+
+	var written atomic.Bool
+	srv.OnWrite(func(aid uint64, iid uint64, value interface{}) int {
+		written.Store(true)
+		return hkontroller.JsonStatusSuccess
+	})
+
+	// fetched characteristics are validated before request
+	err := d.PutCharacteristic(1, hktest.IidBrightness, 150)
+	var valueErr *hkontroller.ValueError
+	if !errors.As(err, &valueErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if is, want := valueErr.Iid, hktest.IidBrightness; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if _, err := d.TimedWrite([]hkontroller.CharacteristicPut{
+		{Aid: 1, Iid: hktest.IidOn, Value: "on"},
+	}, time.Second); !errors.As(err, &valueErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if written.Load() {
+		t.Fatal("invalid value is sent to accessory")
+	}
+
+	if err := d.PutCharacteristic(1, hktest.IidBrightness, 30); err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.GetCharacteristic(1, hktest.IidBrightness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := v, int64(30); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestTimedWrite(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	results, err := d.TimedWrite([]hkontroller.CharacteristicPut{
+		{Aid: 1, Iid: hktest.IidBrightness, Value: 50},
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := results[0].Err; err != nil {
+		t.Fatal(err)
+	}
+	v, err := srv.Value(1, hktest.IidBrightness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := v, float64(50); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	ch, err := d.SubscribeToEvents(1, hktest.IidBrightness)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetValue(1, hktest.IidBrightness, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-ch:
+		if is, want := e.Args[2], float64(42); is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	// subscription is restored after reconnect
+	d.Close()
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetValue(1, hktest.IidBrightness, 43); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-ch:
+		if is, want := e.Args[2], float64(43); is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received after reconnect")
+	}
+}
+
+func TestUnsubscribeUnderAccessorySubscription(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := c.Events(ctx, hkontroller.ForCharacteristic(1, 0))
+
+	if _, err := d.SubscribeToAccessoryEvents(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UnsubscribeFromEvents(1, hktest.IidOn); err != nil {
+		t.Fatal(err)
+	}
+
+	// unsubscribed characteristic is not subscribed again after reconnect
+	d.Close()
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetValue(1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetValue(1, hktest.IidBrightness, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-changes:
+		if is, want := e.(hkontroller.CharacteristicChanged).Iid, hktest.IidBrightness; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received after reconnect")
+	}
+}
+
+func TestResubscribeUnderAccessorySubscription(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+	// accessory subscription is built from accessory list
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+
+	accCh, err := d.SubscribeToAccessoryEvents(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UnsubscribeFromEvents(1, hktest.IidOn); err != nil {
+		t.Fatal(err)
+	}
+
+	// accessory listener is kept
+	if err := srv.SetValue(1, hktest.IidBrightness, 42); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e, ok := <-accCh:
+		if !ok {
+			t.Fatal("accessory listener is closed")
+		}
+		if is, want := e.Args[1], hktest.IidBrightness; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no accessory event received")
+	}
+
+	// unsubscribed characteristic is enabled again, although accessory topic exists
+	ch, err := d.SubscribeToEvents(1, hktest.IidOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetValue(1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-ch:
+		if is, want := e.Args[2], true; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received after subscribing again")
+	}
+}
+
+func TestAccessoriesChanged(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := c.AddDevice(srv.BrowseEntry())
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+
+	changes := d.OnAccessoriesChanged()
+	defer d.OffAccessoriesChanged(changes)
+
+	// accessories were never fetched, so there is nothing to diff with
+	if err := srv.SetAccessories([]*hkontroller.Accessory{hktest.NewLightbulb(1, "Lamp")}); err != nil {
+		t.Fatal(err)
+	}
+	c.AddDevice(srv.BrowseEntry())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.Accessories()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("accessories are not fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case e := <-changes:
+		t.Fatalf("unexpected diff %+v", e.Args[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// config number is bumped with new accessory
+	if err := srv.SetAccessories([]*hkontroller.Accessory{
+		hktest.NewLightbulb(1, "Lamp"),
+		hktest.NewLightbulb(2, "Lamp 2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.AddDevice(srv.BrowseEntry())
+
+	select {
+	case e := <-changes:
+		diff := e.Args[0].(hkontroller.AccessoriesDiff)
+		if is, want := len(diff.AddedAccessories), 1; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if is, want := diff.AddedAccessories[0], uint64(2); is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if is, want := len(diff.RemovedAccessories), 0; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accessories change is not emitted")
+	}
+	if is, want := len(d.Accessories()), 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestAccessoriesChangedWhileDisconnected(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := c.AddDevice(srv.BrowseEntry())
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := d.OnAccessoriesChanged()
+	defer d.OffAccessoriesChanged(changes)
+
+	// accessory restarts with new database and config number
+	d.Close()
+	if err := srv.SetAccessories([]*hkontroller.Accessory{
+		hktest.NewLightbulb(1, "Lamp"),
+		hktest.NewLightbulb(2, "Lamp 2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.AddDevice(srv.BrowseEntry())
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-changes:
+		diff := e.Args[0].(hkontroller.AccessoriesDiff)
+		if is, want := len(diff.AddedAccessories), 1; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		if is, want := diff.AddedAccessories[0], uint64(2); is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accessories change is not emitted")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+
+	// unpaired accessory accepts POST /identify
+	if err := d.Identify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := srv.Identified(), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if err := d.PairSetup(testSetupCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Identify(); err == nil {
+		t.Fatal("paired device is identified without verification")
+	}
+	if err := d.IdentifyUnpaired(); !errors.Is(err, &hkontroller.JsonErrorInsufficientPrivileges) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if is, want := srv.Identified(), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	var identifyWrites atomic.Int32
+	srv.OnWrite(func(aid uint64, iid uint64, value interface{}) int {
+		if aid == 1 && iid == hktest.IidIdentify && value == true {
+			identifyWrites.Add(1)
+		}
+		return hkontroller.JsonStatusSuccess
+	})
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	// verified device writes Identify characteristic
+	if err := d.Identify(); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := identifyWrites.Load(), int32(1); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := d.IdentifyUnpaired(); err == nil {
+		t.Fatal("POST /identify is sent over verified connection")
+	}
+}
+
+func TestPairings(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	pairAndVerify(t, d)
+
+	kp, err := hkontroller.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := hkontroller.Pairing{
+		Id:         "other-controller",
+		PublicKey:  kp.Public,
+		Permission: hkontroller.PermissionUser,
+	}
+	if err := d.PairAdd(other); err != nil {
+		t.Fatal(err)
+	}
+
+	pairings, err := d.ListPairings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(pairings), 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if err := d.RemoveOtherPairings(); err != nil {
+		t.Fatal(err)
+	}
+	pairings, err = d.ListPairings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(pairings), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := pairings[0].Id, testControllerId; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestStaticDevice(t *testing.T) {
+	srv := newTestServer(t)
+	st := hkontroller.NewMemStore()
+
+	c, err := hkontroller.NewController(st, testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddStaticDevice(srv.Name(), "no-port"); err == nil {
+		t.Fatal("invalid address accepted")
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.IsDiscovered() {
+		t.Fatal("static device should not be discovered")
+	}
+	pairAndVerify(t, d)
+	d.Close()
+
+	// pairing is saved with address in background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, _ := st.KeysWithSuffix(".pairing")
+		if len(keys) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pairing is not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c2, err := hkontroller.NewController(st, testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.LoadPairings(); err != nil {
+		t.Fatal(err)
+	}
+	d2 := c2.GetDevice(srv.Name())
+	if d2 == nil {
+		t.Fatal("device is not loaded")
+	}
+	t.Cleanup(func() {
+		d2.Close()
+	})
+	if is, want := d2.StaticAddress(), srv.Addr().String(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if err := d2.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncBuffer is bytes.Buffer safe for concurrent writes of logger.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	srv := newTestServer(t)
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId, hkontroller.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+
+	if err := d.PairSetup("111-22-333"); err == nil {
+		t.Fatal("pair-setup with wrong code succeeded")
+	}
+	pairAndVerify(t, d)
+
+	out := buf.String()
+	for _, want := range []string{
+		`msg="pair-setup failed" device=Lamp step=M4`,
+		`msg="pair-verify done" device=Lamp`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("%q is not logged:\n%s", want, out)
+		}
+	}
+}
+
+func TestKeepConnectedStaticDevice(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	if err := d.PairSetup(testSetupCode); err != nil {
+		t.Fatal(err)
+	}
+
+	states := d.OnConnectionState()
+	defer d.OffConnectionState(states)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.KeepConnected(ctx, hkontroller.ReconnectPolicy{})
+	}()
+
+	// static device is connected without discovery
+	timeout := time.After(5 * time.Second)
+	for connected := false; !connected; {
+		select {
+		case e := <-states:
+			state := e.Args[0].(hkontroller.ConnectionState)
+			if state == hkontroller.ConnectionStateWaitingDiscovery {
+				t.Fatal("static device waits for discovery")
+			}
+			connected = state == hkontroller.ConnectionStateConnected
+		case <-timeout:
+			t.Fatal("not connected")
+		}
+	}
+
+	cancel()
+	go func() {
+		// drain states until loop is stopped
+		for range states {
+		}
+	}()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestKeepConnectedRetriesDroppedVerify(t *testing.T) {
+	srv := newTestServer(t)
+	d := newTestDevice(t, srv)
+	if err := d.PairSetup(testSetupCode); err != nil {
+		t.Fatal(err)
+	}
+	srv.DropPairVerify(2)
+
+	states := d.OnConnectionState()
+	defer d.OffConnectionState(states)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- d.KeepConnected(ctx, hkontroller.ReconnectPolicy{InitialBackoff: 10 * time.Millisecond})
+	}()
+
+	// connection errors during pair-verify are retried
+	backoffs := 0
+	timeout := time.After(5 * time.Second)
+	for connected := false; !connected; {
+		select {
+		case e := <-states:
+			switch e.Args[0].(hkontroller.ConnectionState) {
+			case hkontroller.ConnectionStateBackoff:
+				backoffs++
+			case hkontroller.ConnectionStateConnected:
+				connected = true
+			case hkontroller.ConnectionStateStopped:
+				t.Fatalf("loop stopped: %v", e.Args[1])
+			}
+		case <-timeout:
+			t.Fatal("not connected")
+		}
+	}
+	if is, want := backoffs, 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := d.IsVerified(), true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	cancel()
+	go func() {
+		for range states {
+		}
+	}()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := d.SubscribeToEvents(1, hktest.IidBrightness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range ch {
+		}
+	}()
+
+	const n = 20
+	wg := sync.WaitGroup{}
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// requests may fail while connection is closed and verified again
+	for k := 0; k < 4; k++ {
+		run(func(i int) {
+			d.GetCharacteristic(1, hktest.IidOn)
+			d.PutCharacteristic(1, hktest.IidBrightness, i)
+		})
+	}
+	run(func(i int) {
+		d.Close()
+		d.PairVerify()
+	})
+	run(func(i int) {
+		srv.SetValue(1, hktest.IidBrightness, i)
+	})
+	run(func(i int) {
+		c.AddStaticDevice(srv.Name(), srv.Addr().String())
+		c.GetPairedDevices()
+		c.GetVerifiedDevices()
+		d.IsVerified()
+		d.Info()
+		d.GetDnssdEntry()
+		d.KnownAddress()
+		for _, a := range d.Accessories() {
+			a.GetService(hkontroller.SType_LightBulb)
+		}
+	})
+	wg.Wait()
+
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutCharacteristic(1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(c.GetVerifiedDevices()), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestControllerEvents(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// never read, must not block other subscribers
+	c.Events(ctx)
+	events := c.Events(ctx, hkontroller.ForDevice(srv.Name()))
+	changes := c.Events(ctx, hkontroller.ForCharacteristic(1, hktest.IidBrightness))
+	closed := c.Events(ctx, func(e hkontroller.Event) bool {
+		_, ok := e.(hkontroller.Closed)
+		return ok
+	})
+
+	next := func(ch <-chan hkontroller.Event) hkontroller.Event {
+		t.Helper()
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+		return nil
+	}
+
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+	// emitter channel is not read either
+	if _, err := d.SubscribeToEvents(1, hktest.IidBrightness); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetValue(1, hktest.IidBrightness, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := next(events).(hkontroller.Paired); !ok {
+		t.Fatal("expected Paired")
+	}
+	if e, ok := next(events).(hkontroller.Verified); !ok || e.Device() != d {
+		t.Fatal("expected Verified of device")
+	}
+	ev := next(changes)
+	e, ok := ev.(hkontroller.CharacteristicChanged)
+	if !ok {
+		t.Fatalf("unexpected event %T", ev)
+	}
+	if is, want := e.Value, float64(42); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	// overflow buffers of slow consumers
+	for i := 0; i <= 100; i++ {
+		if err := srv.SetValue(1, hktest.IidBrightness, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctxReq, cancelReq := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelReq()
+	if err := d.PutCharacteristicContext(ctxReq, 1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Close()
+	if e, ok := next(closed).(hkontroller.Closed); !ok || e.Reason == nil {
+		t.Fatal("expected Closed with reason")
+	}
+
+	cancel()
+	for range events {
+		// drained until closed
+	}
+}
+
+func TestStateMirror(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId,
+		hkontroller.WithStateMirror(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	pairAndVerify(t, d)
+	if err := d.GetAccessories(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SubscribeToEvents(1, hktest.IidBrightness); err != nil {
+		t.Fatal(err)
+	}
+
+	brightness := hkontroller.CharacteristicID{Aid: 1, Iid: hktest.IidBrightness}
+	for i := 1; i <= 5; i++ {
+		if err := srv.SetValue(1, hktest.IidBrightness, i*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PutCharacteristic(1, hktest.IidOn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var state hkontroller.DeviceState
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshot := c.Snapshot()
+		if is, want := len(snapshot), 1; is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+		state = snapshot[0]
+		if state.Characteristics[brightness].Value == float64(50) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("events are not mirrored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if is, want := state.Name, srv.Name(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := state.Verified, true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	cs := state.Characteristics[brightness]
+	if is, want := cs.Type, hkontroller.CType_Brightness.ToShort(); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	// history is bounded, oldest values are dropped
+	if is, want := len(cs.History), 3; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	for i, r := range cs.History {
+		if is, want := r.Value, float64((i+2)*10); is != want {
+			t.Fatalf("is=%v want=%v", is, want)
+		}
+	}
+	if cs.Updated.IsZero() || cs.Updated.Before(cs.History[2].Time) {
+		t.Fatal("wrong update time")
+	}
+	if is, want := state.Characteristics[hkontroller.CharacteristicID{Aid: 1, Iid: hktest.IidOn}].Value, true; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	lightbulb := state.Accessories[0].GetService(hkontroller.SType_LightBulb)
+	if is, want := lightbulb.GetCharacteristic(hkontroller.CType_Brightness).Value, float64(50); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if err := d.Unpair(); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(c.Snapshot()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("unpaired device is mirrored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStateMirrorFetchesAccessories(t *testing.T) {
+	srv := newTestServer(t)
+	c, err := hkontroller.NewController(hkontroller.NewMemStore(), testControllerId,
+		hkontroller.WithStateMirror(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.AddStaticDevice(srv.Name(), srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+
+	brightness := hkontroller.CharacteristicID{Aid: 1, Iid: hktest.IidBrightness}
+	waitBrightness := func(value interface{}) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			snapshot := c.Snapshot()
+			if len(snapshot) == 1 && snapshot[0].Characteristics[brightness].Value == value {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("brightness %v is not mirrored", value)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := srv.SetValue(1, hktest.IidBrightness, 30); err != nil {
+		t.Fatal(err)
+	}
+	// accessories are fetched without GetAccessories
+	pairAndVerify(t, d)
+	waitBrightness(float64(30))
+
+	// value changes while device is not connected
+	d.Close()
+	if err := srv.SetValue(1, hktest.IidBrightness, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PairVerify(); err != nil {
+		t.Fatal(err)
+	}
+	waitBrightness(float64(60))
+}
@@ -0,0 +1,249 @@
+package hkontroller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptionKeySize is size of key of encrypted store.
+const EncryptionKeySize = chacha20poly1305.KeySize
+
+// saltKey is key of salt used to derive key from passphrase.
+// It is stored in plain inside inner store.
+const saltKey = "encryption.salt"
+
+const saltSize = 16
+
+// checkKey is key of known value sealed on first use,
+// so store opened with other key is refused before any value is read.
+const checkKey = "encryption.check"
+
+var checkValue = []byte("hkontroller")
+
+// sealedPrefix marks sealed values, so values saved in plain are told apart.
+var sealedPrefix = []byte("hke1")
+
+// ErrNotEncrypted is returned by Get of encrypted store for value saved in plain,
+// e.g. before store was encrypted. See EncryptPlainValues.
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// ErrWrongKey is returned when encrypted store is opened
+// with key or passphrase other than the one it was created with.
+var ErrWrongKey = errors.New("wrong encryption key or passphrase")
+
+// argon2id parameters, as recommended by RFC 9106 for memory constrained environments
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+type encryptedStore struct {
+	inner Store
+	key   []byte
+}
+
+// NewEncryptedStore returns store sealing values with XChaCha20-Poly1305
+// before they are saved in inner store. Key must be EncryptionKeySize long.
+// Values are bound to their keys, so value copied to other key fails to open.
+// Keys themselves are not encrypted.
+// Values saved in inner store in plain before are not readable,
+// Get returns ErrNotEncrypted until they are sealed with EncryptPlainValues.
+// Error wraps ErrWrongKey if inner store was encrypted with other key.
+func NewEncryptedStore(inner Store, key []byte) (Store, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("invalid key size %d, want %d", len(key), EncryptionKeySize)
+	}
+	s := &encryptedStore{
+		inner: inner,
+		key:   append([]byte(nil), key...),
+	}
+	if err := s.verifyKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// verifyKey opens check value, which is saved if store is used first time.
+func (s *encryptedStore) verifyKey() error {
+	sealed, err := s.inner.Get(checkKey)
+	if err != nil {
+		missing, kerr := isMissing(s.inner, checkKey, err)
+		if kerr != nil {
+			return kerr
+		}
+		if !missing {
+			return fmt.Errorf("reading key check failed: %w", err)
+		}
+		if err := s.Set(checkKey, checkValue); err != nil {
+			return fmt.Errorf("saving key check failed: %w", err)
+		}
+		return nil
+	}
+	v, err := s.open(checkKey, sealed)
+	if errors.Is(err, ErrNotEncrypted) {
+		return fmt.Errorf("%w: %v", ErrWrongKey, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(v, checkValue) {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// isMissing reports whether Get of inner store failed because key has no value.
+// Stores are not required to wrap os.ErrNotExist,
+// so for other errors key is looked up in list of keys.
+func isMissing(inner Store, key string, err error) (bool, error) {
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	keys, kerr := inner.KeysWithSuffix(key)
+	if kerr != nil {
+		return false, kerr
+	}
+	for _, k := range keys {
+		if k == key {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// NewPassphraseStore is like NewEncryptedStore but derives key from passphrase with argon2id.
+// Random salt is generated on first use and saved in inner store.
+// Error wraps ErrWrongKey if passphrase differs from the one used first time.
+func NewPassphraseStore(inner Store, passphrase string) (Store, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	salt, err := inner.Get(saltKey)
+	if err != nil {
+		missing, kerr := isMissing(inner, saltKey, err)
+		if kerr != nil {
+			return nil, kerr
+		}
+		if !missing {
+			// don't replace salt which exists but is not readable,
+			// values sealed with it would be lost
+			return nil, fmt.Errorf("reading salt failed: %w", err)
+		}
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if err := inner.Set(saltKey, salt); err != nil {
+			return nil, fmt.Errorf("saving salt failed: %v", err)
+		}
+	} else if len(salt) != saltSize {
+		return nil, fmt.Errorf("invalid salt size %d", len(salt))
+	}
+	return NewEncryptedStore(inner, KeyFromPassphrase(passphrase, salt))
+}
+
+// KeyFromPassphrase derives key for NewEncryptedStore from passphrase and salt with argon2id.
+func KeyFromPassphrase(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, EncryptionKeySize)
+}
+
+// EncryptPlainValues seals values saved in inner store in plain,
+// so store used before without encryption may be encrypted.
+// Store must be returned by NewEncryptedStore or NewPassphraseStore.
+func EncryptPlainValues(st Store) error {
+	s, ok := st.(*encryptedStore)
+	if !ok {
+		return errors.New("store is not encrypted")
+	}
+	keys, err := s.inner.KeysWithSuffix("")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == saltKey {
+			continue
+		}
+		if _, err := s.Get(key); !errors.Is(err, ErrNotEncrypted) {
+			continue
+		}
+		value, err := s.inner.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := s.Set(key, value); err != nil {
+			return fmt.Errorf("encrypting value of %s failed: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Set seals value, prefix and nonce are prepended to sealed value.
+func (s *encryptedStore) Set(key string, value []byte) error {
+	aead, err := chacha20poly1305.NewX(s.key)
+	if err != nil {
+		return err
+	}
+	out := make([]byte, len(sealedPrefix)+aead.NonceSize(), len(sealedPrefix)+aead.NonceSize()+len(value)+aead.Overhead())
+	copy(out, sealedPrefix)
+	nonce := out[len(sealedPrefix):]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.inner.Set(key, aead.Seal(out, nonce, value, []byte(key)))
+}
+
+func (s *encryptedStore) Get(key string) ([]byte, error) {
+	sealed, err := s.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(key, sealed)
+}
+
+// open returns value sealed by Set under key.
+func (s *encryptedStore) open(key string, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(s.key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(sealed, sealedPrefix) {
+		return nil, fmt.Errorf("value of %s: %w", key, ErrNotEncrypted)
+	}
+	sealed = sealed[len(sealedPrefix):]
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("value of %s is truncated", key)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("opening value of %s failed: %w: %v", key, ErrWrongKey, err)
+	}
+	return value, nil
+}
+
+func (s *encryptedStore) Delete(key string) error {
+	return s.inner.Delete(key)
+}
+
+// KeysWithSuffix returns keys of inner store, except salt and check value of encryption.
+func (s *encryptedStore) KeysWithSuffix(suffix string) ([]string, error) {
+	keys, err := s.inner.KeysWithSuffix(suffix)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key == saltKey || key == checkKey {
+			continue
+		}
+		filtered = append(filtered, key)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,212 @@
+package hkontroller
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemStore()
+	st, err := NewPassphraseStore(inner, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(`{"private":"key"}`)
+	if err := st.Set("keypair", value); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := inner.Get("keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("private")) {
+		t.Fatal("value is saved in plain")
+	}
+
+	// same passphrase opens value after restart
+	st, err = NewPassphraseStore(inner, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := st.Get("keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := string(v), string(value); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if _, err := NewPassphraseStore(inner, "other"); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// value is bound to its key
+	if err := inner.Set("other.pairing", sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get("other.pairing"); err == nil {
+		t.Fatal("value is opened under other key")
+	}
+
+	// keys of encryption are not listed
+	keys, err := st.KeysWithSuffix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if is, want := strings.Join(keys, ","), "keypair,other.pairing"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if _, err := NewEncryptedStore(inner, []byte("short")); err == nil {
+		t.Fatal("short key is accepted")
+	}
+}
+
+func TestEncryptedStoreController(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+	fs, err := NewFsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewEncryptedStore(fs, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.localLTSK, c2.localLTSK) {
+		t.Fatal("keypair is not loaded")
+	}
+}
+
+func TestEncryptedStoreWrongKey(t *testing.T) {
+	inner := NewMemStore()
+	st, err := NewEncryptedStore(inner, bytes.Repeat([]byte{1}, EncryptionKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewController(st, "controller"); err != nil {
+		t.Fatal(err)
+	}
+	keypair, err := inner.Get("keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := bytes.Repeat([]byte{2}, EncryptionKeySize)
+	if _, err := NewEncryptedStore(inner, wrongKey); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// without check value wrong key is noticed by controller,
+	// which must not replace keypair it can't read
+	if err := inner.Delete(checkKey); err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := NewEncryptedStore(inner, wrongKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewController(wrong, "controller"); err == nil {
+		t.Fatal("controller is created with unreadable keypair")
+	}
+	v, err := inner.Get("keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, keypair) {
+		t.Fatal("keypair is replaced")
+	}
+}
+
+func TestEncryptPlainValues(t *testing.T) {
+	inner := NewMemStore()
+	plain, err := NewController(inner, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := NewEncryptedStore(inner, bytes.Repeat([]byte{1}, EncryptionKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewController(st, "controller"); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := EncryptPlainValues(st); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := inner.Get("keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, sealedPrefix) {
+		t.Fatal("value is not encrypted")
+	}
+	c, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.localLTSK, plain.localLTSK) {
+		t.Fatal("keypair is not kept")
+	}
+
+	if err := EncryptPlainValues(inner); err == nil {
+		t.Fatal("plain store is accepted")
+	}
+}
+
+// legacyStore reports missing values without wrapping os.ErrNotExist.
+type legacyStore struct {
+	Store
+}
+
+func (s legacyStore) Get(key string) ([]byte, error) {
+	v, err := s.Store.Get(key)
+	if err != nil {
+		return nil, errors.New("not found")
+	}
+	return v, nil
+}
+
+func TestLegacyStore(t *testing.T) {
+	inner := legacyStore{NewMemStore()}
+	if _, err := NewController(inner, "controller"); err != nil {
+		t.Fatal(err)
+	}
+
+	inner = legacyStore{NewMemStore()}
+	st, err := NewPassphraseStore(inner, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = NewPassphraseStore(inner, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewController(st, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.localLTSK, c2.localLTSK) {
+		t.Fatal("keypair is not loaded")
+	}
+	if _, err := NewPassphraseStore(inner, "other"); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package hkontroller
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type PairVerifyError struct {
 	Step string
@@ -15,6 +19,10 @@ func (e *PairVerifyError) Error() string {
 	return fmt.Sprintf("pair-verify error on step %s: %v", e.Step, e.err)
 }
 
+// ErrAccessoryAuthentication is wrapped by PairVerifyError when response of accessory
+// can't be decrypted or its signature is invalid.
+var ErrAccessoryAuthentication = errors.New("accessory authentication failed")
+
 type PairSetupError struct {
 	Step string
 	err  error
@@ -28,6 +36,34 @@ func (p *PairSetupError) Unwrap() error {
 	return p.err
 }
 
+type TimedWriteError struct {
+	Step string
+	err  error
+}
+
+func (e *TimedWriteError) Error() string {
+	return fmt.Sprintf("timed write error on step %s: %v", e.Step, e.err)
+}
+
+func (e *TimedWriteError) Unwrap() error {
+	return e.err
+}
+
+// RetryDelayError is returned when accessory responds with TlvErrorBackoff.
+// Next pair-setup attempt should not be made before RetryDelay passes.
+type RetryDelayError struct {
+	RetryDelay time.Duration
+	err        error
+}
+
+func (e *RetryDelayError) Error() string {
+	return fmt.Sprintf("%v, retry delay %v", e.err, e.RetryDelay)
+}
+
+func (e *RetryDelayError) Unwrap() error {
+	return e.err
+}
+
 type TlvError struct {
 	Code    byte
 	Message string
@@ -37,6 +73,13 @@ func (t *TlvError) Error() string {
 	return fmt.Sprintf("tlv error %x: %s", t.Code, t.Message)
 }
 
+// Is reports whether target is TlvError with the same code,
+// so errors.Is(err, &TlvErrorMaxPeers) may be used.
+func (t *TlvError) Is(target error) bool {
+	e, ok := target.(*TlvError)
+	return ok && e.Code == t.Code
+}
+
 // Error codes for TLV8 communication.
 var (
 	TlvErrorUnknown        = TlvError{0x1, "unknown"}
@@ -63,3 +106,59 @@ func TlvErrorFromCode(code byte) error {
 	}
 	return &TlvErrorUnknown
 }
+
+// JsonStatusError is HAP status code returned for characteristic read or write.
+type JsonStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *JsonStatusError) Error() string {
+	return fmt.Sprintf("hap status %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is JsonStatusError with the same code,
+// so errors.Is(err, &JsonErrorResourceBusy) may be used.
+func (e *JsonStatusError) Is(target error) bool {
+	t, ok := target.(*JsonStatusError)
+	return ok && t.Code == e.Code
+}
+
+// Errors for HAP status codes.
+var (
+	JsonErrorInsufficientPrivileges = JsonStatusError{JsonStatusInsufficientPrivileges,
+		"request denied due to insufficient privileges"}
+	JsonErrorServiceCommunicationFailure = JsonStatusError{JsonStatusServiceCommunicationFailure,
+		"unable to communicate with requested service"}
+	JsonErrorResourceBusy             = JsonStatusError{JsonStatusResourceBusy, "resource is busy, try again"}
+	JsonErrorReadOnlyCharacteristic   = JsonStatusError{JsonStatusReadOnlyCharacteristic, "cannot write to read only characteristic"}
+	JsonErrorWriteOnlyCharacteristic  = JsonStatusError{JsonStatusWriteOnlyCharacteristic, "cannot read from a write only characteristic"}
+	JsonErrorNotificationNotSupported = JsonStatusError{JsonStatusNotificationNotSupported,
+		"notification is not supported for characteristic"}
+	JsonErrorOutOfResource         = JsonStatusError{JsonStatusOutOfResource, "out of resources to process request"}
+	JsonErrorOperationTimedOut     = JsonStatusError{JsonStatusOperationTimedOut, "operation timed out"}
+	JsonErrorResourceDoesNotExist  = JsonStatusError{JsonStatusResourceDoesNotExist, "resource does not exist"}
+	JsonErrorInvalidValueInRequest = JsonStatusError{JsonStatusInvalidValueInRequest, "accessory received an invalid value in a write request"}
+
+	jsonErrors = []JsonStatusError{
+		JsonErrorInsufficientPrivileges, JsonErrorServiceCommunicationFailure,
+		JsonErrorResourceBusy, JsonErrorReadOnlyCharacteristic,
+		JsonErrorWriteOnlyCharacteristic, JsonErrorNotificationNotSupported,
+		JsonErrorOutOfResource, JsonErrorOperationTimedOut,
+		JsonErrorResourceDoesNotExist, JsonErrorInvalidValueInRequest,
+	}
+)
+
+// JsonStatusErrorFromCode returns nil for JsonStatusSuccess
+// and *JsonStatusError for any other code.
+func JsonStatusErrorFromCode(code int) error {
+	if code == JsonStatusSuccess {
+		return nil
+	}
+	for _, e := range jsonErrors {
+		if e.Code == code {
+			return &e
+		}
+	}
+	return &JsonStatusError{code, "unknown"}
+}
@@ -0,0 +1,158 @@
+package hkontroller
+
+import (
+	"context"
+	"sync"
+)
+
+// eventBufferSize is capacity of channel returned by Controller.Events.
+const eventBufferSize = 64
+
+// Event is lifecycle or characteristic event of device,
+// one of DeviceDiscovered, DeviceLost, Paired, Unpaired, Verified,
+// Closed and CharacteristicChanged.
+type Event interface {
+	// Device returns device the event relates to.
+	Device() *Device
+	event()
+}
+
+type deviceEvent struct {
+	d *Device
+}
+
+func (e deviceEvent) Device() *Device { return e.d }
+func (deviceEvent) event()            {}
+
+// DeviceDiscovered is published when device is discovered via mdns
+// or its dnssd entry is updated.
+type DeviceDiscovered struct{ deviceEvent }
+
+// DeviceLost is published when device is removed from mdns.
+type DeviceLost struct{ deviceEvent }
+
+// Paired is published after successful pair-setup.
+type Paired struct{ deviceEvent }
+
+// Unpaired is published when device is unpaired.
+type Unpaired struct{ deviceEvent }
+
+// Verified is published after successful pair-verify.
+type Verified struct{ deviceEvent }
+
+// Closed is published when connection to device is closed.
+type Closed struct {
+	deviceEvent
+	Reason error
+}
+
+// CharacteristicChanged is published on characteristic value notification.
+// Only characteristics subscribed with SubscribeToEvents and similar are notified.
+type CharacteristicChanged struct {
+	deviceEvent
+	Aid   uint64
+	Iid   uint64
+	Value interface{}
+}
+
+// EventFilter reports whether event should be delivered.
+// It is called on publishing goroutine, so it should not block.
+type EventFilter func(Event) bool
+
+// ForDevice passes events of device with given name.
+func ForDevice(name string) EventFilter {
+	return func(e Event) bool {
+		return e.Device().Name == name
+	}
+}
+
+// ForCharacteristic passes CharacteristicChanged events of given characteristic.
+// Aid or iid equal to 0 matches any.
+func ForCharacteristic(aid uint64, iid uint64) EventFilter {
+	return func(e Event) bool {
+		ce, ok := e.(CharacteristicChanged)
+		if !ok {
+			return false
+		}
+		return (aid == 0 || ce.Aid == aid) && (iid == 0 || ce.Iid == iid)
+	}
+}
+
+// eventBus delivers events to subscribers without blocking publisher.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*eventSubscription]struct{}
+}
+
+type eventSubscription struct {
+	ch       chan Event
+	filters  []EventFilter
+	dropping bool // events are dropped since last delivered one
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*eventSubscription]struct{}),
+	}
+}
+
+func (s *eventSubscription) match(e Event) bool {
+	for _, f := range s.filters {
+		if !f(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *eventBus) subscribe(ctx context.Context, filters []EventFilter) <-chan Event {
+	s := &eventSubscription{
+		ch:      make(chan Event, eventBufferSize),
+		filters: filters,
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, s)
+		close(s.ch)
+		b.mu.Unlock()
+	}()
+
+	return s.ch
+}
+
+// publish sends event to matching subscribers.
+// Event is dropped for subscriber whose buffer is full.
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.match(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+			s.dropping = false
+		default:
+			if !s.dropping {
+				e.Device().logger.Warn("event subscriber is too slow, dropping events")
+			}
+			s.dropping = true
+		}
+	}
+}
+
+// Events returns stream of events of all devices passing every filter.
+// Channel is closed when ctx is done.
+// Events are buffered, if consumer falls behind, new events are dropped
+// rather than blocking the device.
+func (c *Controller) Events(ctx context.Context, filters ...EventFilter) <-chan Event {
+	return c.events.subscribe(ctx, filters)
+}
@@ -10,10 +10,11 @@ import (
 )
 
 func main() {
-	c, err := hkontroller.NewController(
-		hkontroller.NewFsStore("./.store"),
-		"hkontrol",
-	)
+	st, err := hkontroller.NewFsStore("./.store")
+	if err != nil {
+		panic(err)
+	}
+	c, err := hkontroller.NewController(st, "hkontrol")
 	if err != nil {
 		panic(err)
 	}
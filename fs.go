@@ -1,14 +1,12 @@
 package hkontroller
 
 import (
-	"github.com/hkontrol/hkontroller/log"
-
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -16,73 +14,155 @@ type fsStore struct {
 	Path string
 }
 
-func NewFsStore(dir string) Store {
+// NewFsStore returns store saving every value in its own file inside dir.
+// Directory is created if it doesn't exist. Files of store saved by older
+// versions are made accessible by owner only, other files are left untouched.
+func NewFsStore(dir string) (Store, error) {
 	// Prepare filesystem directory
 	// Ensure that execute permission bit is set on all created dirs
 	// Read http://unix.stackexchange.com/questions/21251/why-do-directories-need-the-executable-x-permission-to-be-opened
-	err := os.MkdirAll(dir, 0755)
+	// Only owner has access, store contains private key of controller
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating store directory failed: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		log.Info.Panic(err)
+		return nil, err
 	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isStoreFile(e.Name()) {
+			continue
+		}
+		if err := os.Chmod(filepath.Join(dir, e.Name()), 0600); err != nil {
+			return nil, fmt.Errorf("restricting store file failed: %w", err)
+		}
+	}
+
+	return &fsStore{dir}, nil
+}
 
-	return &fsStore{dir}
+// isStoreFile reports whether file name is one of keys saved by controller,
+// directory of store may be shared with other files.
+func isStoreFile(name string) bool {
+	switch name {
+	case "keypair", saltKey, checkKey:
+		return true
+	}
+	for _, suffix := range []string{".pairing", ".address", ".entity"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
+// Set writes value to temporary file, syncs and renames it,
+// so file of key contains either previous or new value even after crash.
 func (fs *fsStore) Set(key string, value []byte) error {
-	file, err := os.OpenFile(fs.filePathToFile(key), os.O_WRONLY|os.O_CREATE, 0666)
+	path, err := fs.filePathToFile(key)
 	if err != nil {
 		return err
 	}
 
-	defer file.Close()
+	tmp, err := os.CreateTemp(fs.Path, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
 
-	_, err = file.Write(value)
-	return err
+	// CreateTemp uses 0600 already, but be explicit
+	if err := tmp.Chmod(0600); err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Write(value); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return fs.syncDir()
 }
 
-func (fs *fsStore) Get(key string) ([]byte, error) {
-	file, err := os.OpenFile(fs.filePathToFile(key), os.O_RDONLY, 0666)
+// syncDir persists rename of file in directory.
+func (fs *fsStore) syncDir() error {
+	if runtime.GOOS == "windows" {
+		// directories can't be synced on windows
+		return nil
+	}
+	dir, err := os.Open(fs.Path)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer dir.Close()
+	return dir.Sync()
+}
 
-	defer file.Close()
-
-	var b bytes.Buffer
-	var buffer = make([]byte, 32)
-	for {
-		n, _ := file.Read(buffer)
-		if n > 0 {
-			b.Write(buffer[:n])
-		} else {
-			break
-		}
+// Get returns content of file of key.
+// Error wraps os.ErrNotExist if there is no value for key.
+func (fs *fsStore) Get(key string) ([]byte, error) {
+	path, err := fs.filePathToFile(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return b.Bytes(), nil
+	return os.ReadFile(path)
 }
 
 // Delete removes the file for the corresponding key.
 func (fs *fsStore) Delete(key string) error {
-	return os.Remove(fs.filePathToFile(key))
+	path, err := fs.filePathToFile(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
 }
 
 func (fs *fsStore) KeysWithSuffix(suffix string) (keys []string, err error) {
-	var infos []os.FileInfo
+	entries, err := os.ReadDir(fs.Path)
+	if err != nil {
+		return nil, err
+	}
 
-	if infos, err = ioutil.ReadDir(fs.Path); err == nil {
-		for _, info := range infos {
-			if info.IsDir() == false && strings.HasSuffix(info.Name(), suffix) == true {
-				keys = append(keys, info.Name())
-			}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			// temporary files are hidden
+			continue
+		}
+		if strings.HasSuffix(e.Name(), suffix) {
+			keys = append(keys, e.Name())
 		}
 	}
 
-	return
+	return keys, nil
 }
 
-func (fs *fsStore) filePathToFile(file string) string {
-	return filepath.Join(fs.Path, sanitizeFilename(file))
+// filePathToFile returns path of file of key.
+// Keys which are not plain file names, e.g. "../keypair", are refused,
+// so value can't be written outside of store directory.
+func (fs *fsStore) filePathToFile(key string) (string, error) {
+	name := sanitizeFilename(key)
+	// names starting with dot are reserved for temporary files
+	if name == "" || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid store key %q", key)
+	}
+	return filepath.Join(fs.Path, name), nil
 }
 
 type storer struct {
@@ -157,6 +237,34 @@ func (st *storer) Pairings() []Pairing {
 	return arr
 }
 
+// KnownAddress returns last known address of device with the given pairing id.
+func (st *storer) KnownAddress(id string) (KnownAddress, error) {
+	var a KnownAddress
+	b, err := st.Get(keyForAddressName(id))
+	if err != nil {
+		return a, err
+	}
+
+	err = json.Unmarshal(b, &a)
+
+	return a, err
+}
+
+// SaveKnownAddress saves last known address of device with the given pairing id.
+func (st *storer) SaveKnownAddress(id string, a KnownAddress) error {
+	b, err := json.Marshal(&a)
+	if err != nil {
+		return err
+	}
+
+	return st.Set(keyForAddressName(id), b)
+}
+
+// DeleteKnownAddress deletes last known address of device with the given pairing id.
+func (st *storer) DeleteKnownAddress(id string) error {
+	return st.Delete(keyForAddressName(id))
+}
+
 // eneity is used in older versions to store public & private keys
 // of the accessory and devices clients.
 // Use Keypair and Pairing instead.
@@ -192,6 +300,10 @@ func keyForPairingName(s string) string {
 	return hex.EncodeToString([]byte(s)) + ".pairing"
 }
 
+func keyForAddressName(s string) string {
+	return hex.EncodeToString([]byte(s)) + ".address"
+}
+
 // sanitizeFilename returns a valid file name by removing invalidcharacters (e.g. colon ":" which is not allowed in file names on Window)
 func sanitizeFilename(filename string) string {
 	return strings.Replace(filename, ":", "", -1)
@@ -0,0 +1,132 @@
+package hkontroller
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFsStore(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewFsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.Set("aa.pairing", []byte(`{"name":"long value"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// shorter value replaces longer one completely
+	if err := st.Set("aa.pairing", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	v, err := st.Get("aa.pairing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := string(v), `{}`; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "aa.pairing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := info.Mode().Perm(), os.FileMode(0600); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	// no temporary files are left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(entries), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	keys, err := st.KeysWithSuffix(".pairing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(keys), 1; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+
+	if _, err := st.Get("bb.pairing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, key := range []string{"", "../keypair", "sub/keypair", ".hidden", ".."} {
+		if err := st.Set(key, []byte("x")); err == nil {
+			t.Fatalf("key %q is accepted", key)
+		}
+		if _, err := st.Get(key); err == nil {
+			t.Fatalf("key %q is accepted", key)
+		}
+	}
+
+	if err := st.Delete("aa.pairing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get("aa.pairing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestFsStorePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions")
+	}
+	dir := t.TempDir()
+	// mode is set explicitly, WriteFile is affected by umask
+	create := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(`{}`), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	keypair := create("keypair")
+	pairing := create("aa.pairing")
+	other := create("notes.txt")
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFsStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{
+		keypair: 0600,
+		pairing: 0600,
+		other:   0666,
+		dir:     0755,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if is := info.Mode().Perm(); is != want {
+			t.Fatalf("%s: is=%v want=%v", filepath.Base(path), is, want)
+		}
+	}
+
+	// created directory is accessible by owner only
+	created := filepath.Join(dir, "store")
+	if _, err := NewFsStore(created); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := info.Mode().Perm(), os.FileMode(0700); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/hkontrol/hkontroller
 
-go 1.19
+go 1.21
 
 require (
 	github.com/hkontrol/dnssd v0.0.0-20230308075609-ab9bce8c8a98
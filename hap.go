@@ -1,5 +1,7 @@
 package hkontroller
 
+import "fmt"
+
 // Status codes for json communication.
 const (
 	JsonStatusSuccess                     = 0
@@ -30,13 +32,39 @@ const (
 	MethodAddPairing    byte = 0x3 // add client through secure connection
 	MethodDeletePairing byte = 0x4 // delete pairing through secure connection
 	MethodListPairings  byte = 0x5
+	MethodResume        byte = 0x6 // resume previous session
 )
 
+// Permission is the permission of controller paired with device.
+type Permission byte
+
 const (
 	// PermissionUser is the user permission for a devices controller.
-	PermissionUser byte = 0x0
+	PermissionUser Permission = 0x0
 	// PermissionAdmin is the administrator permission for a devices controller.
-	PermissionAdmin byte = 0x1
+	PermissionAdmin Permission = 0x1
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionUser:
+		return "user"
+	case PermissionAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(p))
+}
+
+// PairingFlags are sent with Flags TLV during pair-setup.
+type PairingFlags uint32
+
+const (
+	// PairingFlagTransient requests pair-setup which ends after M4
+	// with session keys derived from SRP shared secret and no pairing stored.
+	PairingFlagTransient PairingFlags = 0x00000010
+	// PairingFlagSplit asks accessory to keep SRP salt and verifier,
+	// so later pair-setup with this flag reuses them.
+	PairingFlagSplit PairingFlags = 0x01000000
 )
 
 const (
@@ -0,0 +1,68 @@
+package hktest
+
+import "github.com/hkontrol/hkontroller"
+
+// Instance ids of characteristics created by NewLightbulb.
+const (
+	IidIdentify   uint64 = 2
+	IidName       uint64 = 3
+	IidOn         uint64 = 10
+	IidBrightness uint64 = 11
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// NewLightbulb returns accessory with accessory information and lightbulb services.
+// Lightbulb is off and has brightness of 100.
+func NewLightbulb(aid uint64, name string) *hkontroller.Accessory {
+	return &hkontroller.Accessory{
+		Id: aid,
+		Ss: []*hkontroller.ServiceDescription{
+			{
+				Id:   1,
+				Type: hkontroller.SType_AccessoryInfo,
+				Cs: []*hkontroller.CharacteristicDescription{
+					{
+						Iid:         IidIdentify,
+						Type:        hkontroller.CType_Identify,
+						Permissions: []string{"pw"},
+						Format:      stringPtr("bool"),
+					},
+					{
+						Iid:         IidName,
+						Type:        hkontroller.CType_Name,
+						Value:       name,
+						Permissions: []string{"pr"},
+						Format:      stringPtr("string"),
+					},
+				},
+			},
+			{
+				Id:   9,
+				Type: hkontroller.SType_LightBulb,
+				Cs: []*hkontroller.CharacteristicDescription{
+					{
+						Iid:         IidOn,
+						Type:        hkontroller.CType_On,
+						Value:       false,
+						Permissions: []string{"pr", "pw", "ev"},
+						Format:      stringPtr("bool"),
+					},
+					{
+						Iid:         IidBrightness,
+						Type:        hkontroller.CType_Brightness,
+						Value:       100,
+						Permissions: []string{"pr", "pw", "ev"},
+						Format:      stringPtr("int"),
+						Unit:        stringPtr("percentage"),
+						MinValue:    0,
+						MaxValue:    100,
+						MinStep:     1,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,269 @@
+package hktest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hkontrol/hkontroller"
+)
+
+const (
+	statusSuccess                = hkontroller.JsonStatusSuccess
+	statusInsufficientPrivileges = hkontroller.JsonStatusInsufficientPrivileges
+	statusReadOnly               = hkontroller.JsonStatusReadOnlyCharacteristic
+	statusWriteOnly              = hkontroller.JsonStatusWriteOnlyCharacteristic
+	statusNotificationsDisabled  = hkontroller.JsonStatusNotificationNotSupported
+	statusDoesNotExist           = hkontroller.JsonStatusResourceDoesNotExist
+	statusInvalidValue           = hkontroller.JsonStatusInvalidValueInRequest
+)
+
+// prepared is timed write prepared with PUT /prepare.
+type prepared struct {
+	pid      uint64
+	deadline time.Time
+}
+
+func jsonResponse(status int, v interface{}) response {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return response{status: http.StatusInternalServerError}
+	}
+	return response{status: status, contentType: contentTypeHAPJson, body: b}
+}
+
+func jsonStatusResponse(status int, hapStatus int) response {
+	return jsonResponse(status, map[string]int{"status": hapStatus})
+}
+
+func (c *connection) handleIdentify() response {
+	if c.srv.IsPaired() {
+		return jsonStatusResponse(http.StatusBadRequest, statusInsufficientPrivileges)
+	}
+	c.srv.mu.Lock()
+	c.srv.identified++
+	c.srv.mu.Unlock()
+	return response{status: http.StatusNoContent}
+}
+
+func (c *connection) handleAccessories() response {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	return jsonResponse(http.StatusOK, hkontroller.Accessories{Accs: c.srv.accs})
+}
+
+func (c *connection) handleGetCharacteristics(query url.Values) response {
+	var ids []charId
+	for _, s := range strings.Split(query.Get("id"), ",") {
+		parts := strings.Split(s, ".")
+		if len(parts) != 2 {
+			return jsonStatusResponse(http.StatusBadRequest, statusInvalidValue)
+		}
+		aid, err1 := strconv.ParseUint(parts[0], 10, 64)
+		iid, err2 := strconv.ParseUint(parts[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return jsonStatusResponse(http.StatusBadRequest, statusInvalidValue)
+		}
+		ids = append(ids, charId{aid, iid})
+	}
+	meta := query.Get("meta") == "1"
+	perms := query.Get("perms") == "1"
+	typ := query.Get("type") == "1"
+	ev := query.Get("ev") == "1"
+
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+
+	failed := false
+	var cs []map[string]interface{}
+	for _, id := range ids {
+		item := map[string]interface{}{"aid": id.aid, "iid": id.iid}
+		cs = append(cs, item)
+
+		ch := c.srv.characteristic(id.aid, id.iid)
+		if ch == nil {
+			item["status"] = statusDoesNotExist
+			failed = true
+			continue
+		}
+		if !hasPerm(ch, "pr") {
+			item["status"] = statusWriteOnly
+			failed = true
+			continue
+		}
+		item["value"] = ch.Value
+		if typ {
+			item["type"] = ch.Type
+		}
+		if perms {
+			item["perms"] = ch.Permissions
+		}
+		if ev {
+			item["ev"] = c.isSubscribed(id.aid, id.iid)
+		}
+		if meta {
+			if ch.Format != nil {
+				item["format"] = *ch.Format
+			}
+			if ch.Unit != nil {
+				item["unit"] = *ch.Unit
+			}
+			if ch.MinValue != nil {
+				item["minValue"] = ch.MinValue
+			}
+			if ch.MaxValue != nil {
+				item["maxValue"] = ch.MaxValue
+			}
+			if ch.MinStep != nil {
+				item["minStep"] = ch.MinStep
+			}
+			if ch.MaxLen != nil {
+				item["maxLen"] = *ch.MaxLen
+			}
+			if len(ch.ValidValues) > 0 {
+				item["valid-values"] = ch.ValidValues
+			}
+			if len(ch.ValidRange) > 0 {
+				item["valid-values-range"] = ch.ValidRange
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if failed {
+		// every characteristic has status in multi-status response
+		status = http.StatusMultiStatus
+		for _, item := range cs {
+			if _, ok := item["status"]; !ok {
+				item["status"] = statusSuccess
+			}
+		}
+	}
+	return jsonResponse(status, map[string]interface{}{"characteristics": cs})
+}
+
+func (c *connection) handlePutCharacteristics(body []byte) response {
+	type characteristicWrite struct {
+		Aid      uint64          `json:"aid"`
+		Iid      uint64          `json:"iid"`
+		Value    json.RawMessage `json:"value,omitempty"`
+		Events   *bool           `json:"ev,omitempty"`
+		Response *bool           `json:"r,omitempty"`
+	}
+	var req struct {
+		Cs  []characteristicWrite `json:"characteristics"`
+		Pid *uint64               `json:"pid,omitempty"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return jsonStatusResponse(http.StatusBadRequest, statusInvalidValue)
+	}
+
+	if req.Pid != nil {
+		p := c.prepared
+		c.prepared = nil
+		if p == nil || p.pid != *req.Pid || time.Now().After(p.deadline) {
+			return jsonStatusResponse(http.StatusBadRequest, statusInvalidValue)
+		}
+	}
+
+	type notification struct {
+		aid   uint64
+		iid   uint64
+		value interface{}
+	}
+	var notifications []notification
+
+	failed := false
+	withValues := false
+	var cs []map[string]interface{}
+	for _, w := range req.Cs {
+		item := map[string]interface{}{"aid": w.Aid, "iid": w.Iid}
+		cs = append(cs, item)
+
+		status := c.writeCharacteristic(w.Aid, w.Iid, w.Value, w.Events)
+		if status == statusSuccess && len(w.Value) > 0 {
+			value, _ := c.srv.Value(w.Aid, w.Iid)
+			notifications = append(notifications, notification{w.Aid, w.Iid, value})
+			if w.Response != nil && *w.Response {
+				item["value"] = value
+				withValues = true
+			}
+		}
+		item["status"] = status
+		if status != statusSuccess {
+			failed = true
+		}
+	}
+
+	for _, n := range notifications {
+		c.srv.notify(n.aid, n.iid, n.value, c)
+	}
+
+	if !failed && !withValues {
+		return response{status: http.StatusNoContent}
+	}
+	return jsonResponse(http.StatusMultiStatus, map[string]interface{}{"characteristics": cs})
+}
+
+// writeCharacteristic applies single write and returns HAP status.
+func (c *connection) writeCharacteristic(aid uint64, iid uint64, raw json.RawMessage, ev *bool) int {
+	c.srv.mu.Lock()
+	ch := c.srv.characteristic(aid, iid)
+	if ch == nil {
+		c.srv.mu.Unlock()
+		return statusDoesNotExist
+	}
+	canNotify := hasPerm(ch, "ev")
+	canWrite := hasPerm(ch, "pw")
+	onWrite := c.srv.onWrite
+	c.srv.mu.Unlock()
+
+	if ev != nil {
+		if !canNotify {
+			return statusNotificationsDisabled
+		}
+		c.subscribe(aid, iid, *ev)
+	}
+
+	if len(raw) == 0 {
+		return statusSuccess
+	}
+	if !canWrite {
+		return statusReadOnly
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return statusInvalidValue
+	}
+	if onWrite != nil {
+		if status := onWrite(aid, iid, value); status != statusSuccess {
+			return status
+		}
+	}
+
+	c.srv.mu.Lock()
+	if ch := c.srv.characteristic(aid, iid); ch != nil {
+		ch.Value = value
+	}
+	c.srv.mu.Unlock()
+
+	return statusSuccess
+}
+
+func (c *connection) handlePrepare(body []byte) response {
+	var req struct {
+		Ttl uint64 `json:"ttl"`
+		Pid uint64 `json:"pid"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return jsonStatusResponse(http.StatusBadRequest, statusInvalidValue)
+	}
+	c.prepared = &prepared{
+		pid:      req.Pid,
+		deadline: time.Now().Add(time.Duration(req.Ttl) * time.Millisecond),
+	}
+	return jsonStatusResponse(http.StatusOK, statusSuccess)
+}
@@ -0,0 +1,295 @@
+package hktest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/hkontrol/hkontroller/chacha20poly1305"
+	"github.com/hkontrol/hkontroller/hkdf"
+)
+
+// packetLengthMax is the max length of encrypted frame payload.
+const packetLengthMax = 0x400
+
+// session encrypts data sent by accessory and decrypts data sent by controller.
+type session struct {
+	encryptKey   [32]byte
+	decryptKey   [32]byte
+	encryptCount uint64
+	decryptCount uint64
+}
+
+func newSession(shared []byte) (*session, error) {
+	salt := []byte("Control-Salt")
+
+	encryptKey, err := hkdf.Sha512(shared, salt, []byte("Control-Read-Encryption-Key"))
+	if err != nil {
+		return nil, err
+	}
+	decryptKey, err := hkdf.Sha512(shared, salt, []byte("Control-Write-Encryption-Key"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{encryptKey: encryptKey, decryptKey: decryptKey}, nil
+}
+
+// seal splits message into encrypted frames
+// [ length (2 bytes)] [ data ] [ auth (16 bytes)]
+// Message is terminated with frame shorter than packetLengthMax,
+// as controller reads frames until then.
+func (s *session) seal(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		n := len(b)
+		if n > packetLengthMax {
+			n = packetLengthMax
+		}
+
+		var nonce [8]byte
+		binary.LittleEndian.PutUint64(nonce[:], s.encryptCount)
+		s.encryptCount++
+
+		var length [2]byte
+		binary.LittleEndian.PutUint16(length[:], uint16(n))
+
+		encrypted, mac, err := chacha20poly1305.EncryptAndSeal(s.encryptKey[:], nonce[:], b[:n], length[:])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(length[:])
+		buf.Write(encrypted)
+		buf.Write(mac[:])
+
+		b = b[n:]
+		if n < packetLengthMax {
+			break
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// open reads and decrypts single frame.
+func (s *session) open(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint16(length[:])
+
+	data := make([]byte, int(n)+16)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	var mac [16]byte
+	copy(mac[:], data[n:])
+
+	var nonce [8]byte
+	binary.LittleEndian.PutUint64(nonce[:], s.decryptCount)
+	s.decryptCount++
+
+	return chacha20poly1305.DecryptAndVerify(s.decryptKey[:], nonce[:], data[:n], mac, length[:])
+}
+
+type charId struct {
+	aid uint64
+	iid uint64
+}
+
+// connection is single controller connection.
+// Requests are read and handled in serve goroutine,
+// events may be written from any goroutine, so writes are guarded by wmu.
+type connection struct {
+	net.Conn
+	srv *Server
+
+	wmu sync.Mutex
+	// sess, verified and controllerId are changed by serve goroutine with wmu locked
+	sess         *session
+	verified     bool
+	controllerId string // empty for transient session
+
+	readBuf bytes.Buffer
+
+	emu    sync.Mutex
+	events map[charId]bool
+
+	setup  *setupState
+	verify *verifyState
+
+	prepared *prepared
+}
+
+// response is written by serve loop. after is called once response is sent.
+type response struct {
+	status      int
+	contentType string
+	body        []byte
+	after       func()
+}
+
+func newConnection(s *Server, nc net.Conn) *connection {
+	return &connection{
+		Conn:   nc,
+		srv:    s,
+		events: make(map[charId]bool),
+	}
+}
+
+// Read reads bytes from the connection, decrypting them after session is established.
+func (c *connection) Read(b []byte) (int, error) {
+	if c.sess == nil {
+		return c.Conn.Read(b)
+	}
+	for c.readBuf.Len() == 0 {
+		p, err := c.sess.open(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf.Write(p)
+	}
+	return c.readBuf.Read(b)
+}
+
+func (c *connection) serve() {
+	defer func() {
+		c.Close()
+		c.srv.removeConnection(c)
+	}()
+
+	rd := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+
+		res := c.handle(req, body)
+		if err := c.write("HTTP/1.1", res.status, res.contentType, res.body); err != nil {
+			return
+		}
+		if res.after != nil {
+			res.after()
+		}
+	}
+}
+
+func (c *connection) handle(req *http.Request, body []byte) response {
+	switch req.URL.Path {
+	case "/pair-setup":
+		return c.handlePairSetup(body)
+	case "/pair-verify":
+		return c.handlePairVerify(body)
+	case "/identify":
+		return c.handleIdentify()
+	}
+
+	if !c.isVerified() {
+		return jsonStatusResponse(470, statusInsufficientPrivileges)
+	}
+
+	switch {
+	case req.URL.Path == "/accessories" && req.Method == http.MethodGet:
+		return c.handleAccessories()
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodGet:
+		return c.handleGetCharacteristics(req.URL.Query())
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodPut:
+		return c.handlePutCharacteristics(body)
+	case req.URL.Path == "/prepare" && req.Method == http.MethodPut:
+		return c.handlePrepare(body)
+	case req.URL.Path == "/pairings" && req.Method == http.MethodPost:
+		return c.handlePairings(body)
+	}
+
+	return response{status: http.StatusNotFound}
+}
+
+// write sends HTTP message, EVENT/1.0 proto is used for notifications.
+func (c *connection) write(proto string, status int, contentType string, body []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d %s\r\n", proto, status, http.StatusText(status))
+	if contentType != "" {
+		fmt.Fprintf(&buf, "Content-Type: %s\r\n", contentType)
+	}
+	if status != http.StatusNoContent {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(body))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	b := buf.Bytes()
+	if c.sess != nil {
+		var err error
+		b, err = c.sess.seal(b)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+func (c *connection) writeEvent(body []byte) {
+	if !c.isVerified() {
+		return
+	}
+	if err := c.write("EVENT/1.0", http.StatusOK, contentTypeHAPJson, body); err != nil {
+		c.Close()
+	}
+}
+
+// upgrade switches connection to encrypted session.
+func (c *connection) upgrade(shared []byte, controllerId string) {
+	sess, err := newSession(shared)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.wmu.Lock()
+	c.sess = sess
+	c.verified = true
+	c.controllerId = controllerId
+	c.wmu.Unlock()
+}
+
+func (c *connection) isVerified() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.verified
+}
+
+func (c *connection) pairedControllerId() string {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.controllerId
+}
+
+func (c *connection) subscribe(aid uint64, iid uint64, ev bool) {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	if ev {
+		c.events[charId{aid, iid}] = true
+	} else {
+		delete(c.events, charId{aid, iid})
+	}
+}
+
+func (c *connection) isSubscribed(aid uint64, iid uint64) bool {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	return c.events[charId{aid, iid}]
+}
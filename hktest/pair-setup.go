@@ -0,0 +1,382 @@
+package hktest
+
+import (
+	"crypto/sha512"
+	"errors"
+	"net/http"
+
+	"github.com/hkontrol/hkontroller"
+	"github.com/hkontrol/hkontroller/chacha20poly1305"
+	"github.com/hkontrol/hkontroller/ed25519"
+	"github.com/hkontrol/hkontroller/hkdf"
+	"github.com/hkontrol/hkontroller/tlv8"
+	"github.com/tadglines/go-pkgs/crypto/srp"
+)
+
+const (
+	contentTypePairingTLV8 = "application/pairing+tlv8"
+	contentTypeHAPJson     = "application/hap+json"
+)
+
+// tlv error codes
+const (
+	tlvErrorUnknown        byte = 0x1
+	tlvErrorAuthentication byte = 0x2
+	tlvErrorUnavailable    byte = 0x6
+)
+
+type pairSetupRequest struct {
+	Method        byte   `tlv8:"0"`
+	PublicKey     []byte `tlv8:"3"`
+	Proof         []byte `tlv8:"4"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	Flags         uint32 `tlv8:"19"`
+}
+type pairSetupM2Payload struct {
+	Salt      []byte `tlv8:"2"`
+	PublicKey []byte `tlv8:"3"`
+	State     byte   `tlv8:"6"`
+}
+type pairSetupM2FlagsPayload struct {
+	Salt      []byte `tlv8:"2"`
+	PublicKey []byte `tlv8:"3"`
+	State     byte   `tlv8:"6"`
+	Flags     uint32 `tlv8:"19"`
+}
+type pairSetupM4Payload struct {
+	Proof []byte `tlv8:"4"`
+	State byte   `tlv8:"6"`
+}
+type pairSetupM4MFiPayload struct {
+	Proof         []byte `tlv8:"4"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+}
+type pairSetupMFiPayload struct {
+	Certificate []byte `tlv8:"9"`
+	Signature   []byte `tlv8:"10"`
+}
+type pairSetupSubPayload struct {
+	Identifier string `tlv8:"1"`
+	PublicKey  []byte `tlv8:"3"`
+	Signature  []byte `tlv8:"10"`
+}
+type pairSetupEncPayload struct {
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+}
+type errorPayload struct {
+	State byte `tlv8:"6"`
+	Error byte `tlv8:"7"`
+}
+type retryDelayPayload struct {
+	State      byte   `tlv8:"6"`
+	Error      byte   `tlv8:"7"`
+	RetryDelay uint16 `tlv8:"8"`
+}
+
+// setupState is pair-setup progress of connection.
+type setupState struct {
+	method  byte
+	flags   hkontroller.PairingFlags
+	session *srp.ServerSession
+	key     []byte // SRP shared secret
+}
+
+// splitVerifier is SRP salt and verifier kept for split pair-setup.
+type splitVerifier struct {
+	salt     []byte
+	verifier []byte
+}
+
+func tlvResponse(v interface{}) response {
+	b, err := tlv8.Marshal(v)
+	if err != nil {
+		return response{status: http.StatusInternalServerError}
+	}
+	return response{status: http.StatusOK, contentType: contentTypePairingTLV8, body: b}
+}
+
+func tlvErrorResponse(state byte, code byte) response {
+	return tlvResponse(errorPayload{State: state, Error: code})
+}
+
+func (c *connection) handlePairSetup(body []byte) response {
+	var req pairSetupRequest
+	if err := tlv8.Unmarshal(body, &req); err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+
+	switch req.State {
+	case hkontroller.M1:
+		return c.pairSetupM2(req)
+	case hkontroller.M3:
+		return c.pairSetupM4(req)
+	case hkontroller.M5:
+		return c.pairSetupM6(req)
+	}
+	return tlvErrorResponse(req.State+1, tlvErrorUnknown)
+}
+
+func newSRP() (*srp.SRP, error) {
+	userName := []byte("Pair-Setup")
+	s, err := srp.NewSRP("rfc5054.3072", sha512.New, func(salt, pin []byte) []byte {
+		h := sha512.New()
+		h.Write(userName)
+		h.Write([]byte(":"))
+		h.Write(pin)
+		t2 := h.Sum(nil)
+		h.Reset()
+		h.Write(salt)
+		h.Write(t2)
+		return h.Sum(nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.SaltLength = 16
+	return s, nil
+}
+
+func (c *connection) pairSetupM2(req pairSetupRequest) response {
+	c.setup = nil
+
+	c.srv.mu.Lock()
+	c.srv.setupAttempts++
+	failure := c.srv.setupFailure
+	if failure.times > 0 {
+		c.srv.setupFailure.times--
+	}
+	c.srv.mu.Unlock()
+	if failure.times > 0 {
+		if failure.retryDelay > 0 {
+			return tlvResponse(retryDelayPayload{State: hkontroller.M2, Error: failure.code, RetryDelay: failure.retryDelay})
+		}
+		return tlvErrorResponse(hkontroller.M2, failure.code)
+	}
+
+	flags := hkontroller.PairingFlags(req.Flags) & (hkontroller.PairingFlagTransient | hkontroller.PairingFlagSplit)
+	transient := flags&hkontroller.PairingFlagTransient != 0
+	if req.Method != hkontroller.MethodPair && req.Method != hkontroller.MethodPairMFi {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnavailable)
+	}
+	if c.srv.IsPaired() && !transient {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnavailable)
+	}
+
+	s, err := newSRP()
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+
+	c.srv.mu.Lock()
+	split := c.srv.split
+	setupCode := c.srv.setupCode
+	c.srv.mu.Unlock()
+
+	var salt, verifier []byte
+	if flags&hkontroller.PairingFlagSplit != 0 && split != nil {
+		// reuse verifier of previous split pair-setup
+		salt, verifier = split.salt, split.verifier
+	} else {
+		salt, verifier, err = s.ComputeVerifier([]byte(setupCode))
+		if err != nil {
+			return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+		}
+		if flags&hkontroller.PairingFlagSplit != 0 {
+			c.srv.mu.Lock()
+			c.srv.split = &splitVerifier{salt, verifier}
+			c.srv.mu.Unlock()
+		}
+	}
+
+	session := s.NewServerSession([]byte("Pair-Setup"), salt, verifier)
+	c.setup = &setupState{
+		method:  req.Method,
+		flags:   flags,
+		session: session,
+	}
+
+	if flags != 0 {
+		return tlvResponse(pairSetupM2FlagsPayload{
+			Salt:      salt,
+			PublicKey: session.GetB(),
+			State:     hkontroller.M2,
+			Flags:     uint32(flags),
+		})
+	}
+	return tlvResponse(pairSetupM2Payload{
+		Salt:      salt,
+		PublicKey: session.GetB(),
+		State:     hkontroller.M2,
+	})
+}
+
+func (c *connection) pairSetupM4(req pairSetupRequest) response {
+	st := c.setup
+	if st == nil || st.session == nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+	}
+
+	key, err := st.session.ComputeKey(req.PublicKey)
+	if err != nil {
+		c.setup = nil
+		return tlvErrorResponse(hkontroller.M4, tlvErrorAuthentication)
+	}
+	if !st.session.VerifyClientAuthenticator(req.Proof) {
+		c.setup = nil
+		return tlvErrorResponse(hkontroller.M4, tlvErrorAuthentication)
+	}
+	st.key = key
+	proof := st.session.ComputeAuthenticator(req.Proof)
+
+	var res response
+	if st.method == hkontroller.MethodPairMFi {
+		encrypted, err := c.pairSetupMFiData(key)
+		if err != nil {
+			return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+		}
+		res = tlvResponse(pairSetupM4MFiPayload{Proof: proof, EncryptedData: encrypted, State: hkontroller.M4})
+	} else {
+		res = tlvResponse(pairSetupM4Payload{Proof: proof, State: hkontroller.M4})
+	}
+
+	if st.flags&hkontroller.PairingFlagTransient != 0 {
+		// transient pair-setup ends here, session keys are derived from SRP shared secret
+		c.setup = nil
+		res.after = func() {
+			c.upgrade(key, "")
+		}
+	}
+
+	return res
+}
+
+// pairSetupMFiData returns encrypted certificate and signature of MFi challenge.
+// Signature is made with accessory long-term key instead of authentication coprocessor.
+func (c *connection) pairSetupMFiData(key []byte) ([]byte, error) {
+	challenge, err := hkdf.Sha512(key, []byte("MFi-Pair-Setup-Salt"), []byte("MFi-Pair-Setup-Info"))
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ed25519.Signature(c.srv.ltsk, challenge[:])
+	if err != nil {
+		return nil, err
+	}
+
+	c.srv.mu.Lock()
+	cert := c.srv.certificate
+	c.srv.mu.Unlock()
+
+	b, err := tlv8.Marshal(pairSetupMFiPayload{Certificate: cert, Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+	return sealPairSetup(key, "PS-Msg04", b)
+}
+
+func (c *connection) pairSetupM6(req pairSetupRequest) response {
+	st := c.setup
+	c.setup = nil
+	if st == nil || st.key == nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+
+	decrypted, err := openPairSetup(st.key, "PS-Msg05", req.EncryptedData)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorAuthentication)
+	}
+	var m5 pairSetupSubPayload
+	if err := tlv8.Unmarshal(decrypted, &m5); err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+
+	hash, err := hkdf.Sha512(st.key, []byte("Pair-Setup-Controller-Sign-Salt"), []byte("Pair-Setup-Controller-Sign-Info"))
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+	var material []byte
+	material = append(material, hash[:]...)
+	material = append(material, m5.Identifier...)
+	material = append(material, m5.PublicKey...)
+	if !ed25519.ValidateSignature(m5.PublicKey, material, m5.Signature) {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorAuthentication)
+	}
+
+	hash, err = hkdf.Sha512(st.key, []byte("Pair-Setup-Accessory-Sign-Salt"), []byte("Pair-Setup-Accessory-Sign-Info"))
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+	material = nil
+	material = append(material, hash[:]...)
+	material = append(material, c.srv.id...)
+	material = append(material, c.srv.ltpk...)
+	signature, err := ed25519.Signature(c.srv.ltsk, material)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+
+	b, err := tlv8.Marshal(pairSetupSubPayload{
+		Identifier: c.srv.id,
+		PublicKey:  c.srv.ltpk,
+		Signature:  signature,
+	})
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+	encrypted, err := sealPairSetup(st.key, "PS-Msg06", b)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M6, tlvErrorUnknown)
+	}
+
+	c.srv.mu.Lock()
+	c.srv.pairings[m5.Identifier] = pairing{
+		id:         m5.Identifier,
+		publicKey:  m5.PublicKey,
+		permission: hkontroller.PermissionAdmin,
+	}
+	c.srv.mu.Unlock()
+
+	return tlvResponse(pairSetupEncPayload{EncryptedData: encrypted, State: hkontroller.M6})
+}
+
+func pairSetupKey(key []byte) ([32]byte, error) {
+	return hkdf.Sha512(key, []byte("Pair-Setup-Encrypt-Salt"), []byte("Pair-Setup-Encrypt-Info"))
+}
+
+func sealPairSetup(key []byte, nonce string, b []byte) ([]byte, error) {
+	encKey, err := pairSetupKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return seal(encKey, nonce, b)
+}
+
+func openPairSetup(key []byte, nonce string, data []byte) ([]byte, error) {
+	encKey, err := pairSetupKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return open(encKey, nonce, data)
+}
+
+// seal encrypts b and appends 16 byte MAC.
+func seal(key [32]byte, nonce string, b []byte) ([]byte, error) {
+	encrypted, mac, err := chacha20poly1305.EncryptAndSeal(key[:], []byte(nonce), b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(encrypted, mac[:]...), nil
+}
+
+// open verifies 16 byte MAC at the end of data and decrypts the rest.
+func open(key [32]byte, nonce string, data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	message := data[:len(data)-16]
+	var mac [16]byte
+	copy(mac[:], data[len(message):])
+	return chacha20poly1305.DecryptAndVerify(key[:], []byte(nonce), message, mac, nil)
+}
@@ -0,0 +1,246 @@
+package hktest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/hkontrol/hkontroller"
+	"github.com/hkontrol/hkontroller/chacha20poly1305"
+	"github.com/hkontrol/hkontroller/curve25519"
+	"github.com/hkontrol/hkontroller/ed25519"
+	"github.com/hkontrol/hkontroller/hkdf"
+	"github.com/hkontrol/hkontroller/tlv8"
+)
+
+type pairVerifyRequest struct {
+	Method        byte   `tlv8:"0"`
+	PublicKey     []byte `tlv8:"3"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	SessionId     []byte `tlv8:"14"`
+}
+type pairVerifyM2Payload struct {
+	PublicKey     []byte `tlv8:"3"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+}
+type pairVerifySubPayload struct {
+	Identifier string `tlv8:"1"`
+	Signature  []byte `tlv8:"10"`
+}
+type pairVerifyM4Payload struct {
+	State byte `tlv8:"6"`
+}
+type pairResumeM2Payload struct {
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+	SessionId     []byte `tlv8:"14"`
+}
+
+// verifyState is pair-verify progress of connection.
+type verifyState struct {
+	controllerPublic [32]byte
+	accessoryPublic  [32]byte
+	shared           [32]byte
+}
+
+func (c *connection) handlePairVerify(body []byte) response {
+	var req pairVerifyRequest
+	if err := tlv8.Unmarshal(body, &req); err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+
+	switch req.State {
+	case hkontroller.M1:
+		c.srv.mu.Lock()
+		drop := c.srv.verifyDrops > 0
+		if drop {
+			c.srv.verifyDrops--
+		}
+		c.srv.mu.Unlock()
+		if drop {
+			// response can't be written, so connection is served no more
+			c.Conn.Close()
+			return response{}
+		}
+		if req.Method == hkontroller.MethodResume {
+			if res, ok := c.pairResumeM2(req); ok {
+				return res
+			}
+			// unknown session, continue with pair-verify
+		}
+		return c.pairVerifyM2(req)
+	case hkontroller.M3:
+		return c.pairVerifyM4(req)
+	}
+	return tlvErrorResponse(req.State+1, tlvErrorUnknown)
+}
+
+func (c *connection) pairVerifyM2(req pairVerifyRequest) response {
+	c.verify = nil
+	if len(req.PublicKey) != 32 {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+
+	st := &verifyState{}
+	copy(st.controllerPublic[:], req.PublicKey)
+	var private [32]byte
+	st.accessoryPublic, private = curve25519.GenerateKeyPair()
+	st.shared = curve25519.SharedSecret(private, st.controllerPublic)
+
+	var material []byte
+	material = append(material, st.accessoryPublic[:]...)
+	material = append(material, c.srv.id...)
+	material = append(material, st.controllerPublic[:]...)
+	signature, err := ed25519.Signature(c.srv.ltsk, material)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+
+	b, err := tlv8.Marshal(pairVerifySubPayload{Identifier: c.srv.id, Signature: signature})
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+	encKey, err := pairVerifyKey(st.shared)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+	encrypted, err := seal(encKey, "PV-Msg02", b)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+	}
+
+	c.verify = st
+	return tlvResponse(pairVerifyM2Payload{
+		PublicKey:     st.accessoryPublic[:],
+		EncryptedData: encrypted,
+		State:         hkontroller.M2,
+	})
+}
+
+func (c *connection) pairVerifyM4(req pairVerifyRequest) response {
+	st := c.verify
+	c.verify = nil
+	if st == nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+	}
+
+	encKey, err := pairVerifyKey(st.shared)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+	}
+	decrypted, err := open(encKey, "PV-Msg03", req.EncryptedData)
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorAuthentication)
+	}
+	var m3 pairVerifySubPayload
+	if err := tlv8.Unmarshal(decrypted, &m3); err != nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+	}
+
+	p, ok := c.srv.pairing(m3.Identifier)
+	if !ok {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorAuthentication)
+	}
+	var material []byte
+	material = append(material, st.controllerPublic[:]...)
+	material = append(material, m3.Identifier...)
+	material = append(material, st.accessoryPublic[:]...)
+	if !ed25519.ValidateSignature(p.publicKey, material, m3.Signature) {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorAuthentication)
+	}
+
+	sessionId, err := hkdf.Sha512(st.shared[:], []byte("Pair-Verify-ResumeSessionID-Salt"), []byte("Pair-Verify-ResumeSessionID-Info"))
+	if err != nil {
+		return tlvErrorResponse(hkontroller.M4, tlvErrorUnknown)
+	}
+	c.srv.mu.Lock()
+	c.srv.sessions[hex.EncodeToString(sessionId[:8])] = resumable{
+		shared:       st.shared[:],
+		controllerId: m3.Identifier,
+	}
+	c.srv.mu.Unlock()
+
+	res := tlvResponse(pairVerifyM4Payload{State: hkontroller.M4})
+	res.after = func() {
+		c.upgrade(st.shared[:], m3.Identifier)
+	}
+	return res
+}
+
+// pairResumeM2 resumes session with id sent by controller.
+// It returns false if session is unknown or request can't be verified.
+func (c *connection) pairResumeM2(req pairVerifyRequest) (response, bool) {
+	if len(req.PublicKey) != 32 || len(req.EncryptedData) != 16 {
+		return response{}, false
+	}
+
+	key := hex.EncodeToString(req.SessionId)
+	c.srv.mu.Lock()
+	prev, ok := c.srv.sessions[key]
+	c.srv.mu.Unlock()
+	if !ok {
+		return response{}, false
+	}
+	if _, ok := c.srv.pairing(prev.controllerId); !ok {
+		return response{}, false
+	}
+
+	requestKey, err := pairResumeKey(prev.shared, req.PublicKey, req.SessionId, "Pair-Resume-Request-Info")
+	if err != nil {
+		return response{}, false
+	}
+	var mac [16]byte
+	copy(mac[:], req.EncryptedData)
+	if _, err := chacha20poly1305.DecryptAndVerify(requestKey[:], []byte("PR-Msg01"), nil, mac, nil); err != nil {
+		return response{}, false
+	}
+
+	newId := make([]byte, 8)
+	if _, err := rand.Read(newId); err != nil {
+		return response{}, false
+	}
+	responseKey, err := pairResumeKey(prev.shared, req.PublicKey, newId, "Pair-Resume-Response-Info")
+	if err != nil {
+		return response{}, false
+	}
+	_, responseMac, err := chacha20poly1305.EncryptAndSeal(responseKey[:], []byte("PR-Msg02"), nil, nil)
+	if err != nil {
+		return response{}, false
+	}
+	shared, err := pairResumeKey(prev.shared, req.PublicKey, newId, "Pair-Resume-Shared-Secret-Info")
+	if err != nil {
+		return response{}, false
+	}
+
+	c.srv.mu.Lock()
+	delete(c.srv.sessions, key)
+	c.srv.sessions[hex.EncodeToString(newId)] = resumable{
+		shared:       shared[:],
+		controllerId: prev.controllerId,
+	}
+	c.srv.resumes++
+	c.srv.mu.Unlock()
+
+	res := tlvResponse(pairResumeM2Payload{
+		EncryptedData: responseMac[:],
+		State:         hkontroller.M2,
+		SessionId:     newId,
+	})
+	res.after = func() {
+		c.upgrade(shared[:], prev.controllerId)
+	}
+	return res, true
+}
+
+func pairVerifyKey(shared [32]byte) ([32]byte, error) {
+	return hkdf.Sha512(shared[:], []byte("Pair-Verify-Encrypt-Salt"), []byte("Pair-Verify-Encrypt-Info"))
+}
+
+func pairResumeKey(shared []byte, controllerPublic []byte, sessionId []byte, info string) ([32]byte, error) {
+	var salt []byte
+	salt = append(salt, controllerPublic...)
+	salt = append(salt, sessionId...)
+	return hkdf.Sha512(shared, salt, []byte(info))
+}
@@ -0,0 +1,136 @@
+package hktest
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/hkontrol/hkontroller"
+	"github.com/hkontrol/hkontroller/tlv8"
+)
+
+type pairingsRequest struct {
+	Method      byte   `tlv8:"0"`
+	Identifier  string `tlv8:"1"`
+	PublicKey   []byte `tlv8:"3"`
+	State       byte   `tlv8:"6"`
+	Permissions byte   `tlv8:"11"`
+}
+type pairingsStatePayload struct {
+	State byte `tlv8:"6"`
+}
+type pairingPayload struct {
+	Identifier string `tlv8:"1"`
+	PublicKey  []byte `tlv8:"3"`
+	Permission byte   `tlv8:"11"`
+}
+
+func (c *connection) handlePairings(body []byte) response {
+	var req pairingsRequest
+	if err := tlv8.Unmarshal(body, &req); err != nil {
+		return response{status: http.StatusBadRequest}
+	}
+
+	// only admin controllers may manage pairings
+	p, ok := c.srv.pairing(c.pairedControllerId())
+	if !ok || p.permission != hkontroller.PermissionAdmin {
+		return tlvErrorResponse(hkontroller.M2, tlvErrorAuthentication)
+	}
+
+	switch req.Method {
+	case hkontroller.MethodAddPairing:
+		return c.addPairing(req)
+	case hkontroller.MethodDeletePairing:
+		return c.removePairing(req)
+	case hkontroller.MethodListPairings:
+		return c.listPairings()
+	}
+	return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+}
+
+func (c *connection) addPairing(req pairingsRequest) response {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+
+	if existing, ok := c.srv.pairings[req.Identifier]; ok {
+		if !bytes.Equal(existing.publicKey, req.PublicKey) {
+			return tlvErrorResponse(hkontroller.M2, tlvErrorUnknown)
+		}
+	}
+	c.srv.pairings[req.Identifier] = pairing{
+		id:         req.Identifier,
+		publicKey:  req.PublicKey,
+		permission: hkontroller.Permission(req.Permissions),
+	}
+
+	return tlvResponse(pairingsStatePayload{State: hkontroller.M2})
+}
+
+func (c *connection) removePairing(req pairingsRequest) response {
+	c.srv.mu.Lock()
+	delete(c.srv.pairings, req.Identifier)
+	removed := map[string]bool{req.Identifier: true}
+
+	hasAdmin := false
+	for _, p := range c.srv.pairings {
+		if p.permission == hkontroller.PermissionAdmin {
+			hasAdmin = true
+			break
+		}
+	}
+	if !hasAdmin {
+		// removing last admin removes all pairings
+		for id := range c.srv.pairings {
+			removed[id] = true
+		}
+		c.srv.pairings = make(map[string]pairing)
+	}
+	for id, s := range c.srv.sessions {
+		if removed[s.controllerId] {
+			delete(c.srv.sessions, id)
+		}
+	}
+	c.srv.mu.Unlock()
+
+	res := tlvResponse(pairingsStatePayload{State: hkontroller.M2})
+	res.after = func() {
+		// connections of removed controllers are closed after response
+		for _, cc := range c.srv.connections() {
+			if removed[cc.pairedControllerId()] {
+				cc.Close()
+			}
+		}
+	}
+	return res
+}
+
+func (c *connection) listPairings() response {
+	c.srv.mu.Lock()
+	var pairings []pairing
+	for _, p := range c.srv.pairings {
+		pairings = append(pairings, p)
+	}
+	c.srv.mu.Unlock()
+
+	b, err := tlv8.Marshal(pairingsStatePayload{State: hkontroller.M2})
+	if err != nil {
+		return response{status: http.StatusInternalServerError}
+	}
+	buf := bytes.NewBuffer(b)
+	for i, p := range pairings {
+		if i > 0 {
+			// pairings are separated by 0xff item
+			buf.Write([]byte{0xff, 0x00})
+		}
+		b, err := tlv8.Marshal(pairingPayload{
+			Identifier: p.id,
+			PublicKey:  p.publicKey,
+			Permission: byte(p.permission),
+		})
+		if err != nil {
+			return response{status: http.StatusInternalServerError}
+		}
+		buf.Write(b)
+	}
+
+	return response{status: http.StatusOK, contentType: contentTypePairingTLV8, body: buf.Bytes()}
+}
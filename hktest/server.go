@@ -0,0 +1,451 @@
+// Package hktest provides in-process fake HAP accessory server,
+// so controller can be tested end-to-end without hardware.
+//
+// Server speaks pair-setup, pair-verify, pair-resume, encrypted framing,
+// /accessories, /characteristics, /prepare, /identify, /pairings
+// and sends EVENT notifications on local TCP port.
+package hktest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/hkontrol/dnssd"
+	"github.com/hkontrol/hkontroller"
+	"github.com/hkontrol/hkontroller/ed25519"
+)
+
+// WriteFunc is called for every characteristic write request.
+// Returned HAP status is sent back to controller, value is stored only on JsonStatusSuccess.
+type WriteFunc func(aid uint64, iid uint64, value interface{}) int
+
+type pairing struct {
+	id         string
+	publicKey  []byte
+	permission hkontroller.Permission
+}
+
+// resumable is session which may be resumed with pair-resume.
+type resumable struct {
+	shared       []byte
+	controllerId string
+}
+
+// Server is fake HAP accessory.
+type Server struct {
+	mu sync.Mutex
+
+	id        string
+	name      string
+	setupCode string
+
+	ltpk []byte
+	ltsk []byte
+
+	certificate []byte // presented during MFi pair-setup
+
+	accs         []*hkontroller.Accessory
+	configNumber uint32
+
+	pairings   map[string]pairing
+	sessions   map[string]resumable // by hex encoded session id
+	resumes    int
+	split      *splitVerifier
+	onWrite    WriteFunc
+	listener   net.Listener
+	conns      map[*connection]struct{}
+	closed     bool
+	identified int
+
+	setupAttempts int
+	setupFailure  setupFailure
+	verifyDrops   int
+}
+
+// setupFailure is error returned in M2 of next pair-setup attempts.
+type setupFailure struct {
+	code       byte
+	retryDelay uint16
+	times      int
+}
+
+// NewServer creates server with setup code in form of XXX-XX-XXX and accessory database.
+// Accessories are copied, use SetValue and Value to access characteristic values.
+func NewServer(name string, setupCode string, accs []*hkontroller.Accessory) (*Server, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", b[0], b[1], b[2], b[3], b[4], b[5])
+
+	public, private, err := ed25519.GenerateKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		id:           id,
+		name:         name,
+		setupCode:    setupCode,
+		ltpk:         public[:],
+		ltsk:         private[:],
+		configNumber: 1,
+		pairings:     make(map[string]pairing),
+		sessions:     make(map[string]resumable),
+		conns:        make(map[*connection]struct{}),
+	}
+	if err := s.setAccessories(accs); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Start listens on random port of loopback interface and serves connections in background.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	go s.accept(ln)
+
+	return nil
+}
+
+func (s *Server) accept(ln net.Listener) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := newConnection(s, nc)
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops listening and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	ln := s.listener
+	s.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	s.DropConnections()
+	return err
+}
+
+// DropConnections closes all controller connections, server keeps listening.
+func (s *Server) DropConnections() {
+	for _, c := range s.connections() {
+		c.Close()
+	}
+}
+
+func (s *Server) connections() []*connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*connection
+	for c := range s.conns {
+		result = append(result, c)
+	}
+	return result
+}
+
+func (s *Server) removeConnection(c *connection) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// Addr returns address server is listening on.
+func (s *Server) Addr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+// Name returns name passed to NewServer.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Id returns accessory pairing id in form of XX:XX:XX:XX:XX:XX.
+func (s *Server) Id() string {
+	return s.id
+}
+
+// PublicKey returns accessory long-term public key.
+func (s *Server) PublicKey() []byte {
+	return s.ltpk
+}
+
+// TxtRecord returns TXT record accessory would advertise with _hap._tcp service.
+func (s *Server) TxtRecord() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sf := "1"
+	if len(s.pairings) > 0 {
+		sf = "0"
+	}
+	return map[string]string{
+		"c#": strconv.FormatUint(uint64(s.configNumber), 10),
+		"ff": "0",
+		"id": s.id,
+		"md": s.name,
+		"pv": "1.1",
+		"s#": "1",
+		"sf": sf,
+		"ci": strconv.Itoa(int(hkontroller.Category_Other)),
+	}
+}
+
+// BrowseEntry returns entry controller would resolve via mdns,
+// it may be passed to Controller.AddDevice.
+func (s *Server) BrowseEntry() dnssd.BrowseEntry {
+	addr := s.Addr()
+	return dnssd.BrowseEntry{
+		IPs:  []net.IP{addr.IP},
+		Port: addr.Port,
+		Name: s.name,
+		Type: "_hap._tcp",
+		Text: s.TxtRecord(),
+	}
+}
+
+// SetMFiCertificate sets certificate presented in M4 of MFi pair-setup.
+func (s *Server) SetMFiCertificate(cert []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificate = cert
+}
+
+// OnWrite sets function called on characteristic writes.
+func (s *Server) OnWrite(fn WriteFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onWrite = fn
+}
+
+// IsPaired returns true if server has at least one pairing.
+func (s *Server) IsPaired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pairings) > 0
+}
+
+// Pairings returns list of paired controllers.
+func (s *Server) Pairings() []hkontroller.Pairing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []hkontroller.Pairing
+	for _, p := range s.pairings {
+		result = append(result, hkontroller.Pairing{
+			Id:         p.id,
+			PublicKey:  p.publicKey,
+			Permission: p.permission,
+		})
+	}
+	return result
+}
+
+// ResumedSessions returns number of sessions resumed with pair-resume.
+func (s *Server) ResumedSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumes
+}
+
+// ForgetSessions drops resumable sessions, so next pair-resume falls back to pair-verify.
+func (s *Server) ForgetSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]resumable)
+}
+
+// Identified returns number of received identify requests.
+func (s *Server) Identified() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.identified
+}
+
+// FailPairSetup makes next times pair-setup attempts fail in M2
+// with given tlv error code and retry delay in seconds,
+// e.g. hkontroller.TlvErrorBusy.Code.
+func (s *Server) FailPairSetup(code byte, retryDelay uint16, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setupFailure = setupFailure{code: code, retryDelay: retryDelay, times: times}
+}
+
+// DropPairVerify makes next times pair-verify attempts fail by closing
+// connection on M1 request, as if network failed.
+func (s *Server) DropPairVerify(times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verifyDrops = times
+}
+
+// PairSetupAttempts returns number of received pair-setup M1 requests.
+func (s *Server) PairSetupAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setupAttempts
+}
+
+// Accessories returns copy of accessory database.
+func (s *Server) Accessories() []*hkontroller.Accessory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accs, _ := copyAccessories(s.accs)
+	return accs
+}
+
+// SetAccessories replaces accessory database and increments config number.
+func (s *Server) SetAccessories(accs []*hkontroller.Accessory) error {
+	if err := s.setAccessories(accs); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.configNumber++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) setAccessories(accs []*hkontroller.Accessory) error {
+	copied, err := copyAccessories(accs)
+	if err != nil {
+		return err
+	}
+	for _, a := range copied {
+		for _, ss := range a.Ss {
+			for _, c := range ss.Cs {
+				c.Aid = a.Id
+			}
+		}
+	}
+	s.mu.Lock()
+	s.accs = copied
+	s.mu.Unlock()
+	return nil
+}
+
+// Value returns current value of characteristic.
+func (s *Server) Value(aid uint64, iid uint64) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.characteristic(aid, iid)
+	if c == nil {
+		return nil, fmt.Errorf("no characteristic %d.%d", aid, iid)
+	}
+	return c.Value, nil
+}
+
+// SetValue updates characteristic value as if it was changed on accessory
+// and sends EVENT to every connection subscribed to it.
+func (s *Server) SetValue(aid uint64, iid uint64, value interface{}) error {
+	s.mu.Lock()
+	c := s.characteristic(aid, iid)
+	if c == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("no characteristic %d.%d", aid, iid)
+	}
+	c.Value = value
+	s.mu.Unlock()
+
+	s.notify(aid, iid, value, nil)
+	return nil
+}
+
+// notify sends EVENT to subscribed connections except the one value was written with.
+func (s *Server) notify(aid uint64, iid uint64, value interface{}, except *connection) {
+	type eventPayload struct {
+		Aid   uint64      `json:"aid"`
+		Iid   uint64      `json:"iid"`
+		Value interface{} `json:"value"`
+	}
+	b, err := json.Marshal(struct {
+		Cs []eventPayload `json:"characteristics"`
+	}{[]eventPayload{{aid, iid, value}}})
+	if err != nil {
+		return
+	}
+
+	for _, c := range s.connections() {
+		if c == except || !c.isSubscribed(aid, iid) {
+			continue
+		}
+		c.writeEvent(b)
+	}
+}
+
+// characteristic should be called with s.mu locked.
+func (s *Server) characteristic(aid uint64, iid uint64) *hkontroller.CharacteristicDescription {
+	for _, a := range s.accs {
+		if a.Id != aid {
+			continue
+		}
+		for _, ss := range a.Ss {
+			for _, c := range ss.Cs {
+				if c.Iid == iid {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) pairing(id string) (pairing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pairings[id]
+	return p, ok
+}
+
+func copyAccessories(accs []*hkontroller.Accessory) ([]*hkontroller.Accessory, error) {
+	b, err := json.Marshal(accs)
+	if err != nil {
+		return nil, err
+	}
+	var result []*hkontroller.Accessory
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func hasPerm(c *hkontroller.CharacteristicDescription, perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
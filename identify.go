@@ -0,0 +1,104 @@
+package hkontroller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// primaryAccessoryId is aid of accessory itself or bridge.
+const primaryAccessoryId = 1
+
+// Identify asks accessory to identify itself, e.g. by blinking or beeping.
+// For verified device Identify characteristic of accessory information service is written,
+// for unpaired one POST /identify is sent, see IdentifyUnpaired.
+// Paired device rejects POST /identify, so it should be verified first.
+func (d *Device) Identify() error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.IdentifyContext(ctx)
+}
+
+// IdentifyContext is like Identify but uses ctx for requests.
+func (d *Device) IdentifyContext(ctx context.Context) error {
+	if !d.IsVerified() {
+		if d.IsPaired() {
+			return errors.New("paired device is not verified, call PairVerify before Identify")
+		}
+		return d.IdentifyUnpairedContext(ctx)
+	}
+
+	if len(d.Accessories()) == 0 {
+		if err := d.GetAccessoriesContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range d.Accessories() {
+		if a.Id != primaryAccessoryId {
+			continue
+		}
+		infoS := a.GetService(SType_AccessoryInfo)
+		if infoS == nil {
+			break
+		}
+		identifyC := infoS.GetCharacteristic(CType_Identify)
+		if identifyC == nil {
+			break
+		}
+		return d.PutCharacteristicContext(ctx, a.Id, identifyC.Iid, true)
+	}
+
+	return errors.New("no identify characteristic found")
+}
+
+// IdentifyUnpaired sends POST /identify request.
+// Accessory accepts it only until it is paired.
+func (d *Device) IdentifyUnpaired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.IdentifyUnpairedContext(ctx)
+}
+
+// IdentifyUnpairedContext is like IdentifyUnpaired but uses ctx for connection and request.
+func (d *Device) IdentifyUnpairedContext(ctx context.Context) error {
+	if d.IsVerified() {
+		return errors.New("identify request is not allowed over verified connection")
+	}
+
+	d.connMu.Lock()
+	err := d.ensureConnected(ctx)
+	d.connMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	res, err := d.doPost(ctx, "/identify", HTTPContentTypeHAPJson, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	all, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// accessory that is already paired responds with status
+	type responsePayload struct {
+		Status *int `json:"status"`
+	}
+	var pl responsePayload
+	if err := json.Unmarshal(all, &pl); err == nil && pl.Status != nil {
+		if err := JsonStatusErrorFromCode(*pl.Status); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("invalid status code %v", res.StatusCode)
+}
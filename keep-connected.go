@@ -0,0 +1,260 @@
+package hkontroller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/olebedev/emitter"
+)
+
+// ConnectionState describes the state of a KeepConnected loop.
+type ConnectionState int
+
+const (
+	// ConnectionStateConnecting is reported before each pair-verify attempt.
+	ConnectionStateConnecting ConnectionState = iota
+	// ConnectionStateConnected is reported after pair-verify succeeded.
+	ConnectionStateConnected
+	// ConnectionStateBackoff is reported when the loop waits before the next attempt.
+	ConnectionStateBackoff
+	// ConnectionStateWaitingDiscovery is reported when the device is not advertised via mdns
+	// and has neither static nor last known address.
+	ConnectionStateWaitingDiscovery
+	// ConnectionStateStopped is reported once, when the loop exits.
+	ConnectionStateStopped
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionStateConnecting:
+		return "connecting"
+	case ConnectionStateConnected:
+		return "connected"
+	case ConnectionStateBackoff:
+		return "backoff"
+	case ConnectionStateWaitingDiscovery:
+		return "waiting discovery"
+	case ConnectionStateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ReconnectPolicy defines delays between pair-verify attempts.
+// Zero fields are replaced with values of DefaultReconnectPolicy.
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultReconnectPolicy returns policy starting with 1s delay up to 1 minute.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+	}
+}
+
+func (p ReconnectPolicy) withDefaults() ReconnectPolicy {
+	def := DefaultReconnectPolicy()
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = def.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = def.MaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = def.Multiplier
+	}
+	return p
+}
+
+func (p ReconnectPolicy) next(cur time.Duration) time.Duration {
+	next := time.Duration(float64(cur) * p.Multiplier)
+	if next > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return next
+}
+
+var (
+	ErrKeepConnectedRunning = errors.New("keep connected loop is already running")
+	ErrDeviceUnpaired       = errors.New("device unpaired")
+)
+
+// KeepConnected establishes encrypted session and re-runs pair-verify
+// every time connection is closed or device is discovered again.
+// Delays between failed attempts are defined by policy.
+// It blocks until ctx is done, device is unpaired or accessory rejects pair-verify
+// with TlvError or fails ErrAccessoryAuthentication, and returns the reason.
+// Connection errors during pair-verify are retried.
+// State transitions are reported to OnConnectionState listeners.
+func (d *Device) KeepConnected(ctx context.Context, policy ReconnectPolicy) error {
+	if !d.IsPaired() {
+		return errors.New("pair device before verifying")
+	}
+
+	d.mu.Lock()
+	if d.keepConnected {
+		d.mu.Unlock()
+		return ErrKeepConnectedRunning
+	}
+	d.keepConnected = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.keepConnected = false
+		d.mu.Unlock()
+	}()
+
+	policy = policy.withDefaults()
+
+	// listeners are drained by separate goroutine,
+	// so emitting these topics never waits for pair-verify to finish.
+	// unpairedCh is closed once device is unpaired.
+	wakeCh := make(chan struct{}, 1)
+	unpairedCh := make(chan struct{})
+	done := make(chan struct{})
+
+	closeEv := d.OnClose()
+	discoverEv := d.OnDiscovered()
+	unpairedEv := d.OnUnpaired()
+	defer func() {
+		d.OffClose(closeEv)
+		d.OffDiscovered(discoverEv)
+		d.OffUnpaired(unpairedEv)
+		close(done)
+	}()
+	go drainKeepConnectedEvents(done, closeEv, discoverEv, unpairedEv, wakeCh, unpairedCh)
+
+	stop := func(reason error) error {
+		d.logger.Debug("keep connected stopped", "reason", reason)
+		d.emit("connection", ConnectionStateStopped, reason)
+		return reason
+	}
+
+	backoff := policy.InitialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			d.close(ctx.Err())
+			return stop(ctx.Err())
+		case <-unpairedCh:
+			return stop(ErrDeviceUnpaired)
+		default:
+		}
+
+		if d.IsVerified() {
+			// wait until something happens to connection
+			select {
+			case <-ctx.Done():
+				continue
+			case <-unpairedCh:
+				continue
+			case <-wakeCh:
+				continue
+			}
+		}
+
+		if !d.isReachable() {
+			d.emit("connection", ConnectionStateWaitingDiscovery, nil)
+			select {
+			case <-ctx.Done():
+			case <-unpairedCh:
+			case <-wakeCh:
+			}
+			continue
+		}
+
+		d.emit("connection", ConnectionStateConnecting, nil)
+		err := d.PairVerifyContext(ctx)
+		if err == nil {
+			backoff = policy.InitialBackoff
+			d.emit("connection", ConnectionStateConnected, nil)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			// cancelled during pair-verify
+			continue
+		}
+
+		if verifyRejected(err) {
+			d.close(err)
+			return stop(err)
+		}
+
+		d.logger.Debug("pair-verify failed, retrying", pairingStepAttr(err), "retry", backoff, "err", err)
+		d.emit("connection", ConnectionStateBackoff, err)
+		select {
+		case <-ctx.Done():
+		case <-unpairedCh:
+		case <-time.After(backoff):
+		}
+		backoff = policy.next(backoff)
+	}
+}
+
+// verifyRejected reports whether accessory refused pair-verify or couldn't be
+// authenticated, so repeating it won't help. Connection errors wrapped
+// in PairVerifyError are temporary.
+func verifyRejected(err error) bool {
+	var tlvErr *TlvError
+	return errors.As(err, &tlvErr) || errors.Is(err, ErrAccessoryAuthentication)
+}
+
+func drainKeepConnectedEvents(done <-chan struct{},
+	closeEv, discoverEv, unpairedEv <-chan emitter.Event,
+	wakeCh chan<- struct{}, unpairedCh chan struct{}) {
+
+	notify := func(ch chan<- struct{}) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	unpaired := false
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-closeEv:
+			if !ok {
+				// closed channel is never ready again, others still wake the loop
+				closeEv = nil
+				continue
+			}
+			notify(wakeCh)
+		case _, ok := <-discoverEv:
+			if !ok {
+				discoverEv = nil
+				continue
+			}
+			notify(wakeCh)
+		case _, ok := <-unpairedEv:
+			if !ok {
+				unpairedEv = nil
+				continue
+			}
+			if !unpaired {
+				unpaired = true
+				close(unpairedCh)
+			}
+		}
+	}
+}
+
+// OnConnectionState returns channel receiving state transitions of KeepConnected loop.
+// Event arguments are ConnectionState and error (may be nil).
+func (d *Device) OnConnectionState() <-chan emitter.Event {
+	return d.ee.On("connection")
+}
+func (d *Device) OffConnectionState(ch <-chan emitter.Event) {
+	d.ee.Off("connection", ch)
+}
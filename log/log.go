@@ -1,3 +1,7 @@
+// Package log provides global loggers.
+//
+// Deprecated: library doesn't use it anymore,
+// pass *slog.Logger with hkontroller.WithLogger instead.
 package log
 
 import (
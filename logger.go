@@ -0,0 +1,30 @@
+package hkontroller
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// discardHandler drops all records, it is used if no logger is set.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// pairingStepAttr returns step of failed pair-setup or pair-verify as log attribute.
+func pairingStepAttr(err error) slog.Attr {
+	var setupErr *PairSetupError
+	if errors.As(err, &setupErr) {
+		return slog.String("step", setupErr.Step)
+	}
+	var verifyErr *PairVerifyError
+	if errors.As(err, &verifyErr) {
+		return slog.String("step", verifyErr.Step)
+	}
+	return slog.String("step", "")
+}
@@ -2,37 +2,52 @@ package hkontroller
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"sync"
 )
 
-type memStore map[string][]byte
+// memStore is safe for concurrent use,
+// controller saves pairings and addresses in background.
+type memStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
 
 func NewMemStore() Store {
-	return memStore{}
+	return &memStore{values: make(map[string][]byte)}
 }
 
-func (fs memStore) Set(key string, value []byte) error {
-	fs[key] = value
+func (fs *memStore) Set(key string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.values[key] = value
 
 	return nil
 }
 
-func (fs memStore) Get(key string) ([]byte, error) {
-	if v, ok := fs[key]; ok {
+func (fs *memStore) Get(key string) ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if v, ok := fs.values[key]; ok {
 		return v, nil
 	}
 
-	return nil, fmt.Errorf("no entry for key %s", key)
+	return nil, fmt.Errorf("no entry for key %s: %w", key, os.ErrNotExist)
 }
 
-func (fs memStore) Delete(key string) error {
-	delete(fs, key)
+func (fs *memStore) Delete(key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.values, key)
 
 	return nil
 }
 
-func (fs memStore) KeysWithSuffix(s string) (keys []string, err error) {
-	for k, _ := range fs {
+func (fs *memStore) KeysWithSuffix(s string) (keys []string, err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for k := range fs.values {
 		if strings.HasSuffix(k, s) {
 			keys = append(keys, k)
 		}
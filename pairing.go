@@ -1,8 +1,32 @@
 package hkontroller
 
+import "net"
+
 type Pairing struct {
-	Name       string `json:"name"`
-	Id         string `json:"id"`
-	PublicKey  []byte `json:"pubk"`
-	Permission byte   `json:"permission,omitempty"`
+	Name       string     `json:"name"`
+	Id         string     `json:"id"`
+	PublicKey  []byte     `json:"pubk"`
+	Permission Permission `json:"permission,omitempty"`
+	// Address is static host:port of device, used when it is not discovered via mdns.
+	Address string `json:"address,omitempty"`
+}
+
+// KnownAddress is last address of paired device resolved via mdns.
+// It is saved with pairing, so device can be reached before it is discovered again.
+type KnownAddress struct {
+	IPs       []net.IP `json:"ips"`
+	Port      int      `json:"port"`
+	IfaceName string   `json:"iface,omitempty"`
+}
+
+func (a KnownAddress) equal(b KnownAddress) bool {
+	if a.Port != b.Port || a.IfaceName != b.IfaceName || len(a.IPs) != len(b.IPs) {
+		return false
+	}
+	for i := range a.IPs {
+		if !a.IPs[i].Equal(b.IPs[i]) {
+			return false
+		}
+	}
+	return true
 }
@@ -11,48 +11,54 @@ import (
 )
 
 type session struct {
-	Device Device
-
 	encryptKey [32]byte
 	decryptKey [32]byte
 
 	encryptCount uint64
 	decryptCount uint64
+	emu          sync.Mutex
 	dmu          sync.Mutex
+
+	// resumeId and sharedSecret are used to resume session with pair-resume.
+	resumeId     []byte
+	sharedSecret []byte
 }
 
-func newControllerSession(shared [32]byte, d *Device) (*session, error) {
+func newControllerSession(shared []byte) (*session, error) {
 	salt := []byte("Control-Salt")
 	in := []byte("Control-Read-Encryption-Key")
 	out := []byte("Control-Write-Encryption-Key")
 
-	s := &session{
-		Device: Device{
-			pairing:    d.pairing,
-			discovered: d.discovered,
-			paired:     d.paired,
-			verified:   d.verified,
-		},
-	}
+	s := &session{}
 	var err error
-	s.encryptKey, err = hkdf.Sha512(shared[:], salt, out)
+	s.encryptKey, err = hkdf.Sha512(shared, salt, out)
 	s.encryptCount = 0
 	if err != nil {
 		return nil, err
 	}
 
-	s.decryptKey, err = hkdf.Sha512(shared[:], salt, in)
+	s.decryptKey, err = hkdf.Sha512(shared, salt, in)
 	s.decryptCount = 0
 	if err != nil {
 		return nil, err
 	}
 
+	resumeId, err := hkdf.Sha512(shared, []byte("Pair-Verify-ResumeSessionID-Salt"), []byte("Pair-Verify-ResumeSessionID-Info"))
+	if err != nil {
+		return nil, err
+	}
+	s.resumeId = resumeId[:resumeSessionIdLength]
+	s.sharedSecret = append([]byte(nil), shared...)
+
 	return s, err
 }
 
 // Encrypt return the encrypted data by splitting it into packets
 // [ length (2 bytes)] [ data ] [ auth (16 bytes)]
 func (s *session) Encrypt(r io.Reader) (io.Reader, error) {
+	s.emu.Lock()
+	defer s.emu.Unlock()
+
 	packets := packetsFromBytes(r)
 	var buf bytes.Buffer
 	for _, p := range packets {
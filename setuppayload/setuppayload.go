@@ -0,0 +1,202 @@
+// Package setuppayload encodes and decodes HomeKit setup payload URIs
+// (X-HM://...) printed as QR code or stored in NFC tag of accessory.
+package setuppayload
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	scheme        = "X-HM://"
+	payloadLength = 9 // base36 encoded 45 bit value
+	setupIDLength = 4
+)
+
+// Flags are transports supported by accessory.
+type Flags uint8
+
+const (
+	FlagNFC Flags = 0x1
+	FlagIP  Flags = 0x2
+	FlagBLE Flags = 0x4
+	FlagWAC Flags = 0x8 // wireless accessory configuration
+)
+
+// bit layout of 45 bit payload value
+const (
+	setupCodeBits = 27
+	flagsShift    = 27
+	flagsMask     = 0xf
+	categoryShift = 31
+	categoryMask  = 0xff
+	versionShift  = 43
+	versionMask   = 0x7
+)
+
+var (
+	ErrInvalidURI       = errors.New("invalid setup payload uri")
+	ErrInvalidSetupCode = errors.New("invalid setup code")
+	ErrTrivialSetupCode = errors.New("trivial setup code")
+	ErrInvalidSetupID   = errors.New("invalid setup id")
+)
+
+// Payload is decoded setup payload.
+type Payload struct {
+	Version   uint8
+	Category  uint8  // accessory category, same values as "ci" TXT key
+	Flags     Flags  // supported transports
+	SetupCode string // in form of XXX-XX-XXX
+	SetupID   string // 4 alphanumeric characters, used to compute "sh" TXT value
+}
+
+// Parse decodes X-HM:// uri.
+func Parse(uri string) (Payload, error) {
+	var p Payload
+
+	if len(uri) < len(scheme) || !strings.EqualFold(uri[:len(scheme)], scheme) {
+		return p, ErrInvalidURI
+	}
+	rest := strings.ToUpper(uri[len(scheme):])
+	if len(rest) != payloadLength && len(rest) != payloadLength+setupIDLength {
+		return p, ErrInvalidURI
+	}
+
+	v, err := strconv.ParseUint(rest[:payloadLength], 36, 64)
+	if err != nil {
+		return p, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+	}
+
+	p.Version = uint8((v >> versionShift) & versionMask)
+	p.Category = uint8((v >> categoryShift) & categoryMask)
+	p.Flags = Flags((v >> flagsShift) & flagsMask)
+	p.SetupCode = FormatSetupCode(uint32(v & (1<<setupCodeBits - 1)))
+	if len(rest) > payloadLength {
+		p.SetupID = rest[payloadLength:]
+		if !isValidSetupID(p.SetupID) {
+			return p, ErrInvalidSetupID
+		}
+	}
+
+	if err := ValidateSetupCode(p.SetupCode); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// String encodes payload to X-HM:// uri.
+// It returns empty string if payload is not valid, use Encode to get error.
+func (p Payload) String() string {
+	s, _ := p.Encode()
+	return s
+}
+
+// Encode encodes payload to X-HM:// uri.
+func (p Payload) Encode() (string, error) {
+	code, err := parseSetupCode(p.SetupCode)
+	if err != nil {
+		return "", err
+	}
+	if p.SetupID != "" && !isValidSetupID(p.SetupID) {
+		return "", ErrInvalidSetupID
+	}
+
+	v := uint64(p.Version&versionMask)<<versionShift |
+		uint64(p.Category)<<categoryShift |
+		uint64(p.Flags&flagsMask)<<flagsShift |
+		uint64(code)
+
+	s := strings.ToUpper(strconv.FormatUint(v, 36))
+	s = strings.Repeat("0", payloadLength-len(s)) + s
+
+	return scheme + s + strings.ToUpper(p.SetupID), nil
+}
+
+// SetupHash returns value of "sh" TXT key for given setup id and device id ("id" TXT key).
+func SetupHash(setupID string, deviceID string) string {
+	h := sha512.Sum512([]byte(strings.ToUpper(setupID) + strings.ToUpper(deviceID)))
+	return base64.StdEncoding.EncodeToString(h[:4])
+}
+
+// Matches reports whether payload belongs to accessory
+// advertising setupHash ("sh") and deviceID ("id") TXT values.
+func (p Payload) Matches(setupHash string, deviceID string) bool {
+	if p.SetupID == "" || setupHash == "" || deviceID == "" {
+		return false
+	}
+	return SetupHash(p.SetupID, deviceID) == setupHash
+}
+
+// FormatSetupCode formats numeric setup code as XXX-XX-XXX.
+func FormatSetupCode(code uint32) string {
+	s := fmt.Sprintf("%08d", code)
+	return s[:3] + "-" + s[3:5] + "-" + s[5:]
+}
+
+// NormalizeSetupCode validates setup code given as XXX-XX-XXX or XXXXXXXX
+// and returns it in form of XXX-XX-XXX expected by pair-setup.
+func NormalizeSetupCode(code string) (string, error) {
+	n, err := parseSetupCode(code)
+	if err != nil {
+		return "", err
+	}
+	return FormatSetupCode(n), nil
+}
+
+// ValidateSetupCode checks setup code format and rejects
+// trivial codes not allowed by HAP, e.g. 111-11-111 or 123-45-678.
+func ValidateSetupCode(code string) error {
+	_, err := parseSetupCode(code)
+	return err
+}
+
+func parseSetupCode(code string) (uint32, error) {
+	digits := code
+	if len(code) == 10 {
+		if code[3] != '-' || code[6] != '-' {
+			return 0, ErrInvalidSetupCode
+		}
+		digits = code[:3] + code[4:6] + code[7:]
+	}
+	if len(digits) != 8 {
+		return 0, ErrInvalidSetupCode
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidSetupCode
+		}
+	}
+	if isTrivialSetupCode(digits) {
+		return 0, ErrTrivialSetupCode
+	}
+
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidSetupCode
+	}
+	return uint32(n), nil
+}
+
+func isTrivialSetupCode(digits string) bool {
+	if digits == "12345678" || digits == "87654321" {
+		return true
+	}
+	return strings.Count(digits, digits[:1]) == len(digits)
+}
+
+func isValidSetupID(id string) bool {
+	if len(id) != setupIDLength {
+		return false
+	}
+	for _, c := range strings.ToUpper(id) {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package setuppayload
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse("X-HM://00522H1VM1QJ8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if is, want := p.SetupCode, "031-45-154"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := p.Category, uint8(5); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := p.Flags, FlagIP; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := p.SetupID, "1QJ8"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestParseInvalidSetupID(t *testing.T) {
+	for _, uri := range []string{
+		"X-HM://00522H1VM1QJ-",
+		"X-HM://00522H1VM1Q 8",
+		"X-HM://00522H1VM1QJ*",
+	} {
+		if _, err := Parse(uri); !errors.Is(err, ErrInvalidSetupID) {
+			t.Fatalf("%s: is=%v want=%v", uri, err, ErrInvalidSetupID)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	p := Payload{
+		Category:  5,
+		Flags:     FlagIP,
+		SetupCode: "03145154",
+		SetupID:   "1QJ8",
+	}
+	uri, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := uri, "X-HM://00522H1VM1QJ8"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	p := Payload{SetupCode: "031-45-154", SetupID: "1QJ8"}
+
+	if !p.Matches("Jyv0aQ==", "AA:BB:CC:DD:EE:FF") {
+		t.Fatal("payload should match")
+	}
+	if p.Matches("Jyv0aQ==", "AA:BB:CC:DD:EE:00") {
+		t.Fatal("payload should not match")
+	}
+}
+
+func TestValidateSetupCode(t *testing.T) {
+	tests := map[string]error{
+		"031-45-154": nil,
+		"03145154":   nil,
+		"031-45-15":  ErrInvalidSetupCode,
+		"031 45 154": ErrInvalidSetupCode,
+		"0314515a":   ErrInvalidSetupCode,
+		"111-11-111": ErrTrivialSetupCode,
+		"123-45-678": ErrTrivialSetupCode,
+		"87654321":   ErrTrivialSetupCode,
+	}
+	for code, want := range tests {
+		if is := ValidateSetupCode(code); !errors.Is(is, want) {
+			t.Fatalf("%s: is=%v want=%v", code, is, want)
+		}
+	}
+}
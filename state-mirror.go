@@ -0,0 +1,240 @@
+package hkontroller
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ValueRecord is characteristic value with time it was received.
+type ValueRecord struct {
+	Value interface{}
+	Time  time.Time
+}
+
+// CharacteristicState is mirrored state of characteristic.
+type CharacteristicState struct {
+	Aid     uint64
+	Iid     uint64
+	Type    HapCharacteristicType
+	Value   interface{}
+	Updated time.Time     // last time value was received
+	Changed time.Time     // last time value was different from previous one
+	History []ValueRecord // previous values, oldest first
+}
+
+// DeviceState is mirrored state of device.
+type DeviceState struct {
+	Name     string
+	Verified bool
+	// Accessories with current values of characteristics,
+	// nil until accessories of device are fetched.
+	Accessories     []*Accessory
+	Characteristics map[CharacteristicID]CharacteristicState
+}
+
+// WithStateMirror enables in-memory mirror of characteristic values
+// of verified devices, see Controller.Snapshot.
+// Up to historySize previous values are kept for every characteristic.
+// Mirror is fed by fetched accessories, reads, writes and events,
+// so only characteristics subscribed to events are kept up to date.
+func WithStateMirror(historySize int) ControllerOption {
+	return func(c *Controller) {
+		c.mirror = newStateMirror(historySize)
+	}
+}
+
+// Snapshot returns mirrored state of all devices sorted by name.
+// No requests are made, result is nil if mirror is not enabled with WithStateMirror.
+func (c *Controller) Snapshot() []DeviceState {
+	if c.mirror == nil {
+		return nil
+	}
+	states := c.mirror.snapshot()
+	for i := range states {
+		if d := c.GetDevice(states[i].Name); d != nil {
+			states[i].Verified = d.IsVerified()
+		}
+	}
+	return states
+}
+
+// valueRing keeps last values up to its capacity.
+type valueRing struct {
+	records []ValueRecord
+	next    int
+	full    bool
+}
+
+func (r *valueRing) push(v ValueRecord) {
+	if cap(r.records) == 0 {
+		return
+	}
+	if len(r.records) < cap(r.records) {
+		r.records = append(r.records, v)
+		return
+	}
+	r.records[r.next] = v
+	r.next = (r.next + 1) % len(r.records)
+	r.full = true
+}
+
+// list returns records, oldest first.
+func (r *valueRing) list() []ValueRecord {
+	result := make([]ValueRecord, 0, len(r.records))
+	if r.full {
+		result = append(result, r.records[r.next:]...)
+		result = append(result, r.records[:r.next]...)
+		return result
+	}
+	return append(result, r.records...)
+}
+
+type mirroredCharacteristic struct {
+	state   CharacteristicState // History is filled by snapshot
+	history valueRing
+}
+
+type mirroredDevice struct {
+	accs  []*Accessory
+	chars map[CharacteristicID]*mirroredCharacteristic
+}
+
+// stateMirror is updated by devices and read by Controller.Snapshot.
+// Methods are safe to call on nil mirror, that is if mirror is disabled.
+type stateMirror struct {
+	mu          sync.Mutex
+	historySize int
+	devices     map[string]*mirroredDevice
+}
+
+func newStateMirror(historySize int) *stateMirror {
+	if historySize < 0 {
+		historySize = 0
+	}
+	return &stateMirror{
+		historySize: historySize,
+		devices:     make(map[string]*mirroredDevice),
+	}
+}
+
+// device returns mirrored device, m.mu should be held.
+func (m *stateMirror) device(name string) *mirroredDevice {
+	md, ok := m.devices[name]
+	if !ok {
+		md = &mirroredDevice{chars: make(map[CharacteristicID]*mirroredCharacteristic)}
+		m.devices[name] = md
+	}
+	return md
+}
+
+// update records value of characteristic, m.mu should be held.
+// Numbers are stored as float64, as decoded from json,
+// so written and notified values are comparable.
+func (m *stateMirror) update(md *mirroredDevice, aid uint64, iid uint64, value interface{}, t time.Time) *mirroredCharacteristic {
+	if n, ok := toFloat(value); ok {
+		value = n
+	}
+	id := CharacteristicID{aid, iid}
+	mc, ok := md.chars[id]
+	if !ok {
+		mc = &mirroredCharacteristic{
+			state:   CharacteristicState{Aid: aid, Iid: iid, Value: value, Updated: t, Changed: t},
+			history: valueRing{records: make([]ValueRecord, 0, m.historySize)},
+		}
+		md.chars[id] = mc
+		return mc
+	}
+	if !reflect.DeepEqual(mc.state.Value, value) {
+		mc.history.push(ValueRecord{Value: mc.state.Value, Time: mc.state.Changed})
+		mc.state.Value = value
+		mc.state.Changed = t
+	}
+	mc.state.Updated = t
+	return mc
+}
+
+// setAccessories mirrors structure and values of fetched accessories.
+// Characteristics missing in accessories are forgotten.
+func (m *stateMirror) setAccessories(name string, accs []*Accessory) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md := m.device(name)
+	md.accs = copyAccessories(accs)
+	present := make(map[CharacteristicID]bool)
+	for _, a := range accs {
+		for _, s := range a.Ss {
+			for _, c := range s.Cs {
+				present[CharacteristicID{a.Id, c.Iid}] = true
+				if c.Value == nil {
+					// not readable
+					continue
+				}
+				mc := m.update(md, a.Id, c.Iid, c.Value, now)
+				mc.state.Type = c.Type
+			}
+		}
+	}
+	for id := range md.chars {
+		if !present[id] {
+			delete(md.chars, id)
+		}
+	}
+}
+
+// setValue records value of characteristic received or written.
+func (m *stateMirror) setValue(name string, aid uint64, iid uint64, value interface{}) {
+	if m == nil || value == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.update(m.device(name), aid, iid, value, time.Now())
+}
+
+// remove forgets device, e.g. when it is unpaired.
+func (m *stateMirror) remove(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.devices, name)
+	m.mu.Unlock()
+}
+
+func (m *stateMirror) snapshot() []DeviceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]DeviceState, 0, len(m.devices))
+	for name, md := range m.devices {
+		ds := DeviceState{
+			Name:            name,
+			Accessories:     copyAccessories(md.accs),
+			Characteristics: make(map[CharacteristicID]CharacteristicState, len(md.chars)),
+		}
+		for id, mc := range md.chars {
+			cs := mc.state
+			cs.History = mc.history.list()
+			ds.Characteristics[id] = cs
+		}
+		for _, a := range ds.Accessories {
+			for _, s := range a.Ss {
+				for _, c := range s.Cs {
+					if mc, ok := md.chars[CharacteristicID{a.Id, c.Iid}]; ok {
+						c.Value = mc.state.Value
+					}
+				}
+			}
+		}
+		result = append(result, ds)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -7,6 +7,7 @@ type Store interface {
 	Set(key string, value []byte) error
 
 	// Get returns the value for the given key.
+	// Missing value is best reported with error wrapping os.ErrNotExist.
 	Get(key string) ([]byte, error)
 
 	// Delete deletes the value for the given key.
@@ -0,0 +1,246 @@
+package hkontroller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/olebedev/emitter"
+)
+
+// subscription is an event subscription requested by Subscribe* methods.
+// Zero aid means all accessories, zero iid means all characteristics of accessory.
+// HAP instance ids start with 1, so zero is never valid id.
+type subscription struct {
+	aid uint64
+	iid uint64
+}
+
+func (d *Device) addSubscription(aid uint64, iid uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.subscriptions == nil {
+		d.subscriptions = make(map[subscription]struct{})
+	}
+	d.subscriptions[subscription{aid, iid}] = struct{}{}
+	for s := range d.excluded {
+		if s.covers(aid, iid) {
+			delete(d.excluded, s)
+		}
+	}
+}
+
+// covers reports whether subscription to aid and iid includes s.
+func (s subscription) covers(aid uint64, iid uint64) bool {
+	return (aid == 0 || s.aid == aid) && (iid == 0 || s.iid == iid)
+}
+
+// removeSubscription forgets subscription and all the narrower ones covered by it.
+// If wider subscription remains, e.g. characteristic is unsubscribed under
+// accessory-wide subscription, it is excluded, so it is not restored after pair-verify.
+func (d *Device) removeSubscription(aid uint64, iid uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for s := range d.subscriptions {
+		if s.covers(aid, iid) {
+			delete(d.subscriptions, s)
+		}
+	}
+	for s := range d.excluded {
+		if s.covers(aid, iid) {
+			delete(d.excluded, s)
+		}
+	}
+	for s := range d.subscriptions {
+		if (subscription{aid, iid}).covers(s.aid, s.iid) {
+			if d.excluded == nil {
+				d.excluded = make(map[subscription]struct{})
+			}
+			d.excluded[subscription{aid, iid}] = struct{}{}
+			return
+		}
+	}
+}
+
+// isExcluded reports whether characteristic is unsubscribed explicitly.
+// Zero iid reports whether any characteristic of accessory is.
+func (d *Device) isExcluded(aid uint64, iid uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for s := range d.excluded {
+		if s.covers(aid, iid) || (s.aid == aid && s.iid == 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropSubscriptions forgets all subscriptions and closes listener channels.
+func (d *Device) dropSubscriptions() {
+	d.mu.Lock()
+	d.subscriptions = nil
+	d.excluded = nil
+	d.listeners = nil
+	d.mu.Unlock()
+	d.ee.Off("event*")
+}
+
+// onTopic adds listener of event topic.
+func (d *Device) onTopic(topic string) <-chan emitter.Event {
+	ch := d.ee.On(topic)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listeners == nil {
+		d.listeners = make(map[string][]<-chan emitter.Event)
+	}
+	d.listeners[topic] = append(d.listeners[topic], ch)
+	return ch
+}
+
+// topicListeners returns listeners added for exactly the topic,
+// unlike emitter, which matches topics as patterns.
+func (d *Device) topicListeners(topic string) []<-chan emitter.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]<-chan emitter.Event{}, d.listeners[topic]...)
+}
+
+// eventTopics returns topics with listeners.
+func (d *Device) eventTopics() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []string
+	for topic := range d.listeners {
+		result = append(result, topic)
+	}
+	return result
+}
+
+// offTopic closes given listeners of topic, all of them if none given.
+// Channels are always passed to emitter, otherwise it would close listeners
+// of every matching topic, e.g. of accessory when characteristic is unsubscribed.
+func (d *Device) offTopic(topic string, channels ...<-chan emitter.Event) {
+	d.mu.Lock()
+	var off, keep []<-chan emitter.Event
+	for _, ch := range d.listeners[topic] {
+		if len(channels) == 0 || containsChannel(channels, ch) {
+			off = append(off, ch)
+		} else {
+			keep = append(keep, ch)
+		}
+	}
+	if len(keep) == 0 {
+		delete(d.listeners, topic)
+	} else {
+		d.listeners[topic] = keep
+	}
+	d.mu.Unlock()
+
+	if len(off) > 0 {
+		d.ee.Off(topic, off...)
+	}
+}
+
+func containsChannel(channels []<-chan emitter.Event, ch <-chan emitter.Event) bool {
+	for _, c := range channels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Device) subscriptionList() []subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []subscription
+	for s := range d.subscriptions {
+		result = append(result, s)
+	}
+	return result
+}
+
+// restoreSubscriptions sends ev:true for every remembered subscription.
+// It is called after successful pair-verify, so listeners keep receiving events after reconnect.
+func (d *Device) restoreSubscriptions(ctx context.Context) error {
+	subs := d.subscriptionList()
+	if len(subs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reqTimeout)
+	defer cancel()
+
+	for _, s := range subs {
+		if (s.aid == 0 || s.iid == 0) && len(d.Accessories()) == 0 {
+			// payload for wildcard subscriptions is built from accessory list
+			if err := d.GetAccessoriesContext(ctx); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	type charId struct {
+		aid uint64
+		iid uint64
+	}
+	seen := make(map[charId]bool)
+	var cs []CharacteristicPut
+	for _, s := range subs {
+		var pl []CharacteristicPut
+		wildcard := true
+		if s.aid == 0 {
+			pl = d.getEventPutPayloadForAccessory(-1, true)
+		} else if s.iid == 0 {
+			pl = d.getEventPutPayloadForAccessory(int(s.aid), true)
+		} else {
+			ev := true
+			pl = []CharacteristicPut{{Aid: s.aid, Iid: s.iid, Events: &ev}}
+			wildcard = false
+		}
+		for _, p := range pl {
+			id := charId{p.Aid, p.Iid}
+			if seen[id] || (wildcard && d.isExcluded(p.Aid, p.Iid)) {
+				continue
+			}
+			seen[id] = true
+			cs = append(cs, p)
+		}
+	}
+	if len(cs) == 0 {
+		return nil
+	}
+
+	return d.putEvents(ctx, cs)
+}
+
+// putEvents sends PUT /characteristics request with ev fields.
+func (d *Device) putEvents(ctx context.Context, cs []CharacteristicPut) error {
+	type putPayload struct {
+		Cs []CharacteristicPut `json:"characteristics"`
+	}
+
+	b, err := json.Marshal(putPayload{Cs: cs})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/characteristics", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	res, err := d.doRequest(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		return errors.New("not 204")
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package hkontroller
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrTimedWriteExpired is returned if prepared write could not be sent within its TTL.
+var ErrTimedWriteExpired = errors.New("timed write ttl expired")
+
+type preparePayload struct {
+	TTL uint64 `json:"ttl"` // milliseconds
+	Pid uint64 `json:"pid"`
+}
+
+type prepareResponsePayload struct {
+	Status *int `json:"status"`
+}
+
+// TimedWrite writes values using HAP timed write procedure.
+// First PUT /prepare is sent with generated pid and ttl,
+// then values are written with the same pid before ttl expires.
+// It is required by accessories like locks and garage door openers.
+// Failures are returned as *TimedWriteError.
+func (d *Device) TimedWrite(cs []CharacteristicPut, ttl time.Duration) ([]CharacteristicResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+	defer cancel()
+	return d.TimedWriteContext(ctx, cs, ttl)
+}
+
+// TimedWriteContext is like TimedWrite but uses ctx for requests.
+func (d *Device) TimedWriteContext(ctx context.Context, cs []CharacteristicPut, ttl time.Duration) ([]CharacteristicResult, error) {
+	if ttl < time.Millisecond {
+		return nil, &TimedWriteError{"prepare", fmt.Errorf("invalid ttl %v", ttl)}
+	}
+
+	// invalid values fail before anything is prepared
+	if _, err := d.validateWrites(cs); err != nil {
+		return nil, &TimedWriteError{"prepare", err}
+	}
+
+	pid, err := generatePid()
+	if err != nil {
+		return nil, &TimedWriteError{"prepare", err}
+	}
+
+	started := time.Now()
+	err = d.prepare(ctx, pid, ttl)
+	if err != nil {
+		return nil, &TimedWriteError{"prepare", err}
+	}
+
+	// accessory discards write after ttl since prepare request,
+	// so there is no reason to wait longer
+	expires := started.Add(ttl)
+	if time.Now().After(expires) {
+		return nil, &TimedWriteError{"write", ErrTimedWriteExpired}
+	}
+	wctx, cancel := context.WithDeadline(ctx, expires)
+	defer cancel()
+
+	results, err := d.putCharacteristics(wctx, cs, &pid)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = ErrTimedWriteExpired
+		}
+		return nil, &TimedWriteError{"write", err}
+	}
+
+	return results, nil
+}
+
+// prepare sends PUT /prepare request.
+func (d *Device) prepare(ctx context.Context, pid uint64, ttl time.Duration) error {
+	b, err := json.Marshal(preparePayload{
+		TTL: uint64(ttl / time.Millisecond),
+		Pid: pid,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", "/prepare", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", HTTPContentTypeHAPJson)
+
+	res, err := d.doRequest(req)
+	if err != nil {
+		return err
+	}
+
+	all, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var pl prepareResponsePayload
+	if len(all) > 0 {
+		if err := json.Unmarshal(all, &pl); err != nil {
+			return err
+		}
+	}
+	if pl.Status != nil {
+		if err := JsonStatusErrorFromCode(*pl.Status); err != nil {
+			return err
+		}
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("invalid status code %v", res.StatusCode)
+	}
+
+	return nil
+}
+
+// generatePid returns random non-zero pid for timed write.
+func generatePid() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if pid := binary.LittleEndian.Uint64(b[:]); pid != 0 {
+			return pid, nil
+		}
+	}
+}
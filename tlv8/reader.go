@@ -198,7 +198,8 @@ func read(r io.Reader) (map[byte][]bucket, error) {
 	var h = map[byte][]bucket{}
 
 	var tag, n byte
-	var lastItemWasDelimiter bool
+	var lastTag byte
+	var hasLastItem bool
 	for {
 		if err := binary.Read(r, binary.LittleEndian, &tag); err != nil {
 			if err == io.EOF {
@@ -216,18 +217,17 @@ func read(r io.Reader) (map[byte][]bucket, error) {
 		}
 
 		if len(v) > 0 {
-			if l, ok := h[tag]; ok {
-				if lastItemWasDelimiter {
-					h[tag] = append(l, v)
-				} else {
-					h[tag] = []bucket{append(l[0], v...)}
-				}
+			if l, ok := h[tag]; ok && hasLastItem && lastTag == tag {
+				// consecutive items with the same tag are fragments of single value
+				l[len(l)-1] = append(l[len(l)-1], v...)
 			} else {
-				h[tag] = []bucket{v}
+				// item separated by another tag or delimiter (0x00 or 0xff with zero length)
+				h[tag] = append(h[tag], v)
 			}
 		}
 
-		lastItemWasDelimiter = tag == 0 && n == 0
+		lastTag = tag
+		hasLastItem = true
 	}
 
 	return h, nil
@@ -43,3 +43,43 @@ func TestUnmarshalPerson(t *testing.T) {
 		t.Fatalf("is=%v want=%v", is, want)
 	}
 }
+
+func TestUnmarshalSeparatedList(t *testing.T) {
+	type pairing struct {
+		Id         string `tlv8:"1"`
+		Key        []byte `tlv8:"3"`
+		Permission byte   `tlv8:"11"`
+	}
+	type list struct {
+		State    byte      `tlv8:"6"`
+		Pairings []pairing `tlv8:"-"`
+	}
+
+	b := []byte{
+		6, 1, 2,
+		1, 1, 'a', 3, 2, 1, 2, 11, 1, 1,
+		0xff, 0,
+		1, 1, 'b', 3, 2, 3, 4, 11, 1, 0,
+	}
+
+	var l list
+	if err := Unmarshal(b, &l); err != nil {
+		t.Fatal(err)
+	}
+
+	if is, want := l.State, byte(2); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := len(l.Pairings), 2; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := l.Pairings[0].Id, "a"; is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := l.Pairings[1].Key, []byte{3, 4}; string(is) != string(want) {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+	if is, want := l.Pairings[1].Permission, byte(0); is != want {
+		t.Fatalf("is=%v want=%v", is, want)
+	}
+}